@@ -29,6 +29,9 @@ import (
 	"github.com/kurin/visage"
 	"github.com/kurin/visage/oauth2/github"
 	"github.com/kurin/visage/oauth2/google"
+	"github.com/kurin/visage/oauth2/oidc"
+	"github.com/kurin/visage/oauth2/session"
+	"github.com/kurin/visage/provider"
 	"github.com/kurin/visage/web"
 )
 
@@ -36,9 +39,14 @@ var (
 	port   = flag.String("port", "8080", "port to listen on")
 	domain = flag.String("domain", "", "domain (for TLS)")
 	admin  = flag.String("admin", "", "admin user specification")
+	state  = flag.String("state", "", "JSON file in which to persist shares")
+	db     = flag.String("state_db", "", "bolt database in which to persist shares")
+	theme  = flag.String("templates", "", "directory of templates that override the built-in ones")
+	keys   = flag.String("cookie_keys", "", "file of cookie signing and encryption keys, newest first")
+	hide   = flag.Bool("conceal", false, "report files users cannot access as not found")
 )
 
-func ghcfg() *github.Config {
+func ghcfg(keys []session.KeyPair) *github.Config {
 	id := os.Getenv("GH_CLIENT_ID")
 	secret := os.Getenv("GH_CLIENT_SECRET")
 	url := os.Getenv("GH_REDIRECT_URL")
@@ -50,10 +58,11 @@ func ghcfg() *github.Config {
 		ClientSecret: secret,
 		RedirectURI:  url,
 		LogoutPath:   "/github.logout.bye",
+		Keys:         keys,
 	}
 }
 
-func gcfg() *google.Config {
+func gcfg(keys []session.KeyPair) *google.Config {
 	id := os.Getenv("GOOG_CLIENT_ID")
 	secret := os.Getenv("GOOG_CLIENT_SECRET")
 	url := os.Getenv("GOOG_REDIRECT_URL")
@@ -65,9 +74,47 @@ func gcfg() *google.Config {
 		ClientSecret: secret,
 		RedirectURI:  url,
 		LogoutPath:   "/google.logout.bye",
+		Keys:         keys,
 	}
 }
 
+func oidccfg(keys []session.KeyPair) *oidc.Config {
+	issuer := os.Getenv("OIDC_ISSUER")
+	id := os.Getenv("OIDC_CLIENT_ID")
+	secret := os.Getenv("OIDC_CLIENT_SECRET")
+	url := os.Getenv("OIDC_REDIRECT_URL")
+	if issuer == "" || id == "" || secret == "" || url == "" {
+		return nil
+	}
+	scheme := os.Getenv("OIDC_SCHEME")
+	if scheme == "" {
+		scheme = "oidc"
+	}
+	return &oidc.Config{
+		Scheme:       scheme,
+		Issuer:       issuer,
+		ClientID:     id,
+		ClientSecret: secret,
+		RedirectURI:  url,
+		LogoutPath:   "/" + scheme + ".logout.bye",
+		Keys:         keys,
+	}
+}
+
+func providers(keys []session.KeyPair) []provider.Provider {
+	var ps []provider.Provider
+	if c := gcfg(keys); c != nil {
+		ps = append(ps, c)
+	}
+	if c := ghcfg(keys); c != nil {
+		ps = append(ps, c)
+	}
+	if c := oidccfg(keys); c != nil {
+		ps = append(ps, c)
+	}
+	return ps
+}
+
 func main() {
 	flag.Parse()
 
@@ -79,27 +126,56 @@ func main() {
 			Cache:      autocert.DirCache(os.TempDir()),
 		}
 	}
-	a, err := web.ParseGrant(*admin)
-	if err != nil {
-		fmt.Println(err)
-		return
+	var ks []session.KeyPair
+	if *keys != "" {
+		var err error
+		ks, err = session.ReadKeyFile(*keys)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 	}
-	ag, _ := a.Make()
 	w := web.Server{
-		Visage: visage.New(),
-		GitHub: ghcfg(),
-		Google: gcfg(),
-		Admin:  ag,
+		Visage:      visage.New(),
+		Providers:   providers(ks),
+		TemplateDir: *theme,
+		Conceal:     *hide,
+	}
+	if *admin != "" {
+		reg := provider.NewRegistry(w.Providers...)
+		a, err := web.ParseGrant(reg, *admin)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		w.Admin, _ = a.Make(reg)
+	}
+	if key := os.Getenv("VISAGE_LINK_KEY"); key != "" {
+		w.LinkKey = []byte(key)
+	}
+	switch {
+	case *db != "":
+		bs, err := web.NewBoltStore(*db)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer bs.Close()
+		w.Store = bs
+	case *state != "":
+		w.Store = web.NewFileStore(*state)
 	}
 	w.Visage.AddFileSystem(visage.NewDirectory("/tmp"))
 	w.Visage.AddFileSystem(visage.NewDirectory("/var/log"))
-	if err := w.RegisterHandlers("/"); err != nil {
+	mux := http.NewServeMux()
+	if err := w.RegisterHandlers(mux, "/"); err != nil {
 		fmt.Println(err)
 		return
 	}
 	if *domain != "" {
 		server := &http.Server{
-			Addr: ":" + *port,
+			Addr:    ":" + *port,
+			Handler: mux,
 			TLSConfig: &tls.Config{
 				GetCertificate: certManager.GetCertificate,
 			},
@@ -107,5 +183,5 @@ func main() {
 		server.ListenAndServeTLS("", "")
 		return
 	}
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	log.Fatal(http.ListenAndServe(":"+*port, mux))
 }
@@ -0,0 +1,71 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage_test
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kurin/visage"
+	"github.com/kurin/visage/visagetest"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestConformance(t *testing.T) {
+	entity, err := openpgp.NewEntity("visage", "test", "visage@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name string
+		fs   func(root string) visage.FileSystem
+	}{
+		{
+			name: "directory",
+			fs:   visage.NewDirectory,
+		},
+		{
+			name: "directory refusing links",
+			fs: func(root string) visage.FileSystem {
+				return visage.NewLinkDirectory(root, visage.RefuseLinks)
+			},
+		},
+		{
+			name: "memory",
+			fs:   func(string) visage.FileSystem { return visage.NewMemory() },
+		},
+		{
+			name: "encrypted directory",
+			fs: func(root string) visage.FileSystem {
+				return visage.NewEncryptedDirectory(root, []*openpgp.Entity{entity}, entity)
+			},
+		},
+	}
+
+	for _, ent := range table {
+		t.Run(ent.name, func(t *testing.T) {
+			d, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(d)
+			visagetest.TestFileSystem(t, ent.fs(d))
+		})
+	}
+}
@@ -0,0 +1,115 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// FileSystemContext is a FileSystem whose methods take a context, so that
+// slow backends can give up when the caller does.  Each method behaves as
+// its FileSystem counterpart, except that it should stop and return the
+// context's error if the context is done.
+//
+// Views use these methods whenever their file system has them.  To register
+// a FileSystemContext with a Share, convert it with FromContext.
+type FileSystemContext interface {
+	// String is a unique, descriptive identifier for this file system.
+	String() string
+
+	OpenContext(ctx context.Context, path string) (io.ReadCloser, error)
+	CreateContext(ctx context.Context, path string) (io.WriteCloser, error)
+	StatContext(ctx context.Context, path string) (os.FileInfo, error)
+	ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error)
+}
+
+// ToContext returns fs as a FileSystemContext.  If fs does not already
+// implement FileSystemContext, the context is checked before each call, but
+// calls already made are not interrupted.
+func ToContext(fs FileSystem) FileSystemContext {
+	if fsc, ok := fs.(FileSystemContext); ok {
+		return fsc
+	}
+	return withContext{fs}
+}
+
+// FromContext returns fs as a FileSystem.  The FileSystem methods use a
+// background context, but the result also implements FileSystemContext, so
+// a View of it will pass its context through.
+func FromContext(fs FileSystemContext) FileSystem {
+	switch f := fs.(type) {
+	case FileSystem:
+		return f
+	case withContext:
+		return f.fs
+	}
+	return withoutContext{fs}
+}
+
+type withContext struct {
+	fs FileSystem
+}
+
+func (w withContext) String() string { return w.fs.String() }
+
+func (w withContext) OpenContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return w.fs.Open(path)
+}
+
+func (w withContext) CreateContext(ctx context.Context, path string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return w.fs.Create(path)
+}
+
+func (w withContext) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return w.fs.Stat(path)
+}
+
+func (w withContext) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return w.fs.ReadDir(path)
+}
+
+type withoutContext struct {
+	FileSystemContext
+}
+
+func (w withoutContext) Open(path string) (io.ReadCloser, error) {
+	return w.OpenContext(context.Background(), path)
+}
+
+func (w withoutContext) Create(path string) (io.WriteCloser, error) {
+	return w.CreateContext(context.Background(), path)
+}
+
+func (w withoutContext) Stat(path string) (os.FileInfo, error) {
+	return w.StatContext(context.Background(), path)
+}
+
+func (w withoutContext) ReadDir(path string) ([]os.FileInfo, error) {
+	return w.ReadDirContext(context.Background(), path)
+}
@@ -0,0 +1,123 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+)
+
+type testKey struct{}
+
+// blockingFS is a FileSystemContext whose reads of directories wait until
+// the context is done, and which records the last context it was given.
+type blockingFS struct {
+	last context.Context
+}
+
+func (b *blockingFS) String() string { return "blocking" }
+
+func (b *blockingFS) OpenContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	b.last = ctx
+	return ioutil.NopCloser(strings.NewReader(path)), nil
+}
+
+func (b *blockingFS) CreateContext(ctx context.Context, path string) (io.WriteCloser, error) {
+	b.last = ctx
+	return nil, os.ErrPermission
+}
+
+func (b *blockingFS) StatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	b.last = ctx
+	return fileInfo{name: path, dir: true}, nil
+}
+
+func (b *blockingFS) ReadDirContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	b.last = ctx
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFileSystemContext(t *testing.T) {
+	bfs := &blockingFS{}
+	s := New()
+	fs := FromContext(bfs)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fs.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), testKey{}, "request")
+	r, err := v.Open(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if bfs.last == nil || bfs.last.Value(testKey{}) != "request" {
+		t.Errorf("Open: backend did not get the caller's context")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := v.ReadDir(ctx, "/"); err != context.DeadlineExceeded {
+		t.Errorf("ReadDir: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, _, err := v.List(ctx, ListOptions{}); err != context.DeadlineExceeded {
+		t.Errorf("List: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestContextAdapters(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	fs := NewDirectory(d)
+	fsc := ToContext(fs)
+	if got := FromContext(fsc); got != fs {
+		t.Errorf("FromContext(ToContext(fs)): got %v, want %v", got, fs)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := fsc.ReadDirContext(ctx, "/"); err != nil {
+		t.Errorf("ReadDirContext: %v", err)
+	}
+	cancel()
+	if _, err := fsc.ReadDirContext(ctx, "/"); err != context.Canceled {
+		t.Errorf("ReadDirContext after cancel: got %v, want %v", err, context.Canceled)
+	}
+
+	bfs := &blockingFS{}
+	if got := ToContext(FromContext(bfs)); got.String() != bfs.String() {
+		t.Errorf("ToContext(FromContext(fs)): got %v", got)
+	}
+	if _, err := FromContext(bfs).Open("a"); err != nil || bfs.last != context.Background() {
+		t.Errorf("Open: got %v, context %v; want the background context", err, bfs.last)
+	}
+}
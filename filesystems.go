@@ -25,33 +25,58 @@ import (
 )
 
 // NewDirectory creates a FileSystem that serves files with the given path at
-// the root.
-func NewDirectory(path string) FileSystem { return directory(path) }
+// the root.  Symbolic links are followed only if they lead to somewhere
+// beneath the root.
+func NewDirectory(path string) FileSystem { return directory{root: path} }
+
+// NewLinkDirectory is like NewDirectory, but follows symbolic links according
+// to the given policy.
+func NewLinkDirectory(path string, links LinkPolicy) FileSystem {
+	return directory{root: path, links: links}
+}
 
 // Directory exposes a local directory as a FileSystem.
-type directory string
+type directory struct {
+	root  string
+	links LinkPolicy
+}
 
-func (d directory) String() string { return string(d) }
+func (d directory) String() string { return d.root }
 
 func (d directory) Open(path string) (io.ReadCloser, error) {
-	return os.Open(absPath(string(d), path))
+	p, err := resolve(d.root, d.links, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
 }
 
 func (d directory) Create(path string) (io.WriteCloser, error) {
-	return os.Create(absPath(string(d), path))
+	p, err := resolve(d.root, d.links, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(p)
 }
 
 func (d directory) Stat(path string) (os.FileInfo, error) {
-	return os.Stat(absPath(string(d), path))
-}
-
-func (d directory) ReadDir(path string) ([]os.FileInfo, error) {
-	f, err := os.Open(absPath(string(d), path))
-	defer f.Close()
+	p, err := resolve(d.root, d.links, "stat", path)
 	if err != nil {
 		return nil, err
 	}
-	return f.Readdir(0)
+	return os.Stat(p)
+}
+
+func (d directory) ReadDir(path string) ([]os.FileInfo, error) {
+	return readDir(d.root, d.links, path)
+}
+
+func (d directory) Lstat(path string) (os.FileInfo, error) {
+	return lstat(d.root, d.links, path)
+}
+
+func (d directory) Readlink(path string) (string, error) {
+	return readlink(d.root, d.links, path)
 }
 
 // NewEncryptedDirectory returns a FileSystem that serves files from the given
@@ -67,6 +92,7 @@ func NewEncryptedDirectory(path string, recipients []*openpgp.Entity, signer *op
 
 type encryptedDir struct {
 	root       string
+	links      LinkPolicy
 	recipients []*openpgp.Entity
 	signer     *openpgp.Entity
 }
@@ -76,11 +102,36 @@ func (e *encryptedDir) String() string {
 }
 
 func (e *encryptedDir) Create(path string) (io.WriteCloser, error) {
-	f, err := os.Create(absPath(e.root, path))
+	p, err := resolve(e.root, e.links, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	w, err := openpgp.Encrypt(f, e.recipients, e.signer, &openpgp.FileHints{IsBinary: true}, nil)
 	if err != nil {
+		f.Close()
+		os.Remove(p)
 		return nil, err
 	}
-	return openpgp.Encrypt(f, e.recipients, e.signer, &openpgp.FileHints{IsBinary: true}, nil)
+	return &encryptedWriter{WriteCloser: w, f: f}, nil
+}
+
+// encryptedWriter closes the file beneath the encrypted stream once the
+// stream is finished.
+type encryptedWriter struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (ew *encryptedWriter) Close() error {
+	err := ew.WriteCloser.Close()
+	if ferr := ew.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
 }
 
 type encryptedReader struct {
@@ -107,7 +158,11 @@ func (er *encryptedReader) Close() error {
 }
 
 func (e *encryptedDir) Open(path string) (io.ReadCloser, error) {
-	f, err := os.Open(absPath(e.root, path))
+	p, err := resolve(e.root, e.links, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
@@ -127,20 +182,39 @@ func (e *encryptedDir) Open(path string) (io.ReadCloser, error) {
 }
 
 func (e *encryptedDir) Stat(path string) (os.FileInfo, error) {
-	return os.Stat(absPath(e.root, path))
+	p, err := resolve(e.root, e.links, "stat", path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
 }
 
 func (e *encryptedDir) ReadDir(path string) ([]os.FileInfo, error) {
-	f, err := os.Open(absPath(e.root, path))
-	defer f.Close()
+	return readDir(e.root, e.links, path)
+}
+
+func (e *encryptedDir) Lstat(path string) (os.FileInfo, error) {
+	return lstat(e.root, e.links, path)
+}
+
+func (e *encryptedDir) Readlink(path string) (string, error) {
+	return readlink(e.root, e.links, path)
+}
+
+func readDir(root string, links LinkPolicy, path string) ([]os.FileInfo, error) {
+	p, err := resolve(root, links, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	return f.Readdir(0)
 }
 
 // absPath returns a path that is guaranteed to be under root.
 func absPath(root, path string) string {
-	path = filepath.Join("/", path)
-	return filepath.Join(root, path)
+	return filepath.Join(root, cleanPath(path))
 }
@@ -15,8 +15,10 @@
 package visage
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -75,6 +77,131 @@ func TestDir(t *testing.T) {
 	}
 
 	for _, ent := range table {
+		root := filepath.Join(d, ent.root)
+		if err := os.MkdirAll(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		fs := NewDirectory(root)
+		for name, body := range ent.files {
+			w, err := fs.Create(name)
+			if err != nil {
+				t.Fatalf("Create(%q): %v", name, err)
+			}
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Fatalf("Create(%q): write: %v", name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Create(%q): close: %v", name, err)
+			}
+		}
+		for name, want := range ent.files {
+			r, err := fs.Open(name)
+			if err != nil {
+				t.Fatalf("Open(%q): %v", name, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("Open(%q): read: %v", name, err)
+			}
+			if string(got) != want {
+				t.Errorf("Open(%q): got %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+// linkTree makes a directory tree with symbolic links that lead within it,
+// out of it, and back up it, and returns the tree's root.
+func linkTree(t *testing.T, d string) string {
+	root := filepath.Join(d, "root")
+	outside := filepath.Join(d, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "a"), filepath.Join(root, "sub", "b"), filepath.Join(outside, "secret")} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"in":       "sub",
+		"abs":      filepath.Join(root, "sub"),
+		"out":      filepath.Join("..", "outside"),
+		"dangling": filepath.Join("..", "outside", "new"),
+		"sub/loop": "..",
+	}
+	for name, dest := range links {
+		if err := os.Symlink(dest, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestLinkPolicy(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	root := linkTree(t, d)
 
+	table := []struct {
+		links  LinkPolicy
+		open   []string
+		refuse []string
+	}{
+		{
+			links:  FollowLinks,
+			open:   []string{"a", "in/b", "abs/b", "out/secret", "sub/loop/a"},
+			refuse: nil,
+		},
+		{
+			links:  FollowWithinRoot,
+			open:   []string{"a", "in/b", "abs/b", "sub/loop/a"},
+			refuse: []string{"out/secret", "out", "dangling"},
+		},
+		{
+			links:  RefuseLinks,
+			open:   []string{"a", "sub/b"},
+			refuse: []string{"in/b", "abs/b", "out/secret", "sub/loop/a", "dangling"},
+		},
+	}
+
+	for _, ent := range table {
+		fs := NewLinkDirectory(root, ent.links).(LinkFileSystem)
+		for _, p := range ent.open {
+			r, err := fs.Open(p)
+			if err != nil {
+				t.Errorf("policy %d: Open(%q): %v", ent.links, p, err)
+				continue
+			}
+			r.Close()
+		}
+		for _, p := range ent.refuse {
+			_, err := fs.Stat(p)
+			if pe, ok := err.(*os.PathError); !ok || pe.Err != ErrLinkRefused {
+				t.Errorf("policy %d: Stat(%q): got %v, want %v", ent.links, p, err, ErrLinkRefused)
+			}
+		}
+		if _, err := fs.Create("dangling"); (err == nil) != (ent.links == FollowLinks) {
+			t.Errorf("policy %d: Create(dangling): got %v", ent.links, err)
+		}
+		os.Remove(filepath.Join(d, "outside", "new"))
+
+		fi, err := fs.Lstat("in")
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("policy %d: Lstat(in): got %v, %v; want a link", ent.links, fi, err)
+		}
+	}
+
+	fs := NewDirectory(root).(LinkFileSystem)
+	for p, want := range map[string]string{"in": "sub", "abs": "/sub", "sub/loop": ".."} {
+		if got, err := fs.Readlink(p); err != nil || got != want {
+			t.Errorf("Readlink(%q): got %q, %v; want %q", p, got, err, want)
+		}
 	}
 }
@@ -0,0 +1,203 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// FromFS exposes fsys, such as an embed.FS, as a read-only FileSystem with
+// the given name.
+func FromFS(name string, fsys fs.FS) FileSystem {
+	return iofs{name: name, fsys: fsys}
+}
+
+type iofs struct {
+	name string
+	fsys fs.FS
+}
+
+// fsName converts a FileSystem path to an io/fs one.
+func fsName(path string) string {
+	if p := cleanPath(path); p != "/" {
+		return p[1:]
+	}
+	return "."
+}
+
+func (f iofs) String() string { return f.name }
+
+func (f iofs) Open(path string) (io.ReadCloser, error) {
+	return f.fsys.Open(fsName(path))
+}
+
+func (f iofs) Create(path string) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "open", Path: path, Err: fs.ErrPermission}
+}
+
+func (f iofs) Stat(path string) (os.FileInfo, error) {
+	return fs.Stat(f.fsys, fsName(path))
+}
+
+func (f iofs) ReadDir(path string) ([]os.FileInfo, error) {
+	ents, err := fs.ReadDir(f.fsys, fsName(path))
+	if err != nil {
+		return nil, err
+	}
+	var fis []os.FileInfo
+	for _, ent := range ents {
+		fi, err := ent.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fis = append(fis, fi)
+	}
+	return fis, nil
+}
+
+// FS returns the View as an fs.FS, whose every call is checked as though it
+// were made with ctx.  As with Walk, directories list only what the caller
+// can see.  Paths the caller may not access give errors wrapping ErrNoAccess,
+// or fs.ErrNotExist if the View conceals them.  Pass the result to http.FS
+// to serve it with http.FileServer.
+func (v View) FS(ctx context.Context) fs.FS {
+	v.Listing = HideDenied
+	return viewFSys{v: &v, ctx: ctx}
+}
+
+type viewFSys struct {
+	v   *View
+	ctx context.Context
+}
+
+// pathError returns err as an error about name, which is how io/fs reports
+// errors, rather than about the underlying path.
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (f viewFSys) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := f.v.Stat(f.ctx, name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if fi.IsDir() {
+		return &viewDir{fsys: f, name: name, fi: fi}, nil
+	}
+	rc, err := f.v.Open(f.ctx, name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	file := viewFile{ReadCloser: rc, fi: fi}
+	if s, ok := rc.(io.Seeker); ok {
+		return seekFile{viewFile: file, Seeker: s}, nil
+	}
+	return file, nil
+}
+
+func (f viewFSys) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := f.v.Stat(f.ctx, name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+func (f viewFSys) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	fis, err := f.v.ReadDir(f.ctx, name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	ents := make([]fs.DirEntry, len(fis))
+	for i, fi := range fis {
+		ents[i] = fs.FileInfoToDirEntry(fi)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, nil
+}
+
+type viewFile struct {
+	io.ReadCloser
+	fi os.FileInfo
+}
+
+func (f viewFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+type seekFile struct {
+	viewFile
+	io.Seeker
+}
+
+// viewDir is an open directory of a View's fs.FS.
+type viewDir struct {
+	fsys viewFSys
+	name string
+	fi   os.FileInfo
+	ents []fs.DirEntry
+	read bool
+}
+
+func (d *viewDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+func (d *viewDir) Close() error               { return nil }
+
+func (d *viewDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *viewDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		ents, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.ents, d.read = ents, true
+	}
+	if n <= 0 {
+		ents := d.ents
+		d.ents = nil
+		return ents, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.ents) {
+		n = len(d.ents)
+	}
+	ents := d.ents[:n]
+	d.ents = d.ents[n:]
+	return ents, nil
+}
@@ -0,0 +1,104 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/okay"
+)
+
+func TestFromFS(t *testing.T) {
+	mtime := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	m := fstest.MapFS{
+		"a.txt":         {Data: []byte("a"), ModTime: mtime},
+		"dir/b.txt":     {Data: []byte("b"), ModTime: mtime},
+		"dir/sub/c.txt": {Data: []byte("c"), ModTime: mtime},
+		"empty":         {Mode: fs.ModeDir | 0755, ModTime: mtime},
+	}
+	s := New()
+	fsys := FromFS("map", m)
+	if err := s.AddFileSystem(fsys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fsys.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fsys.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(v.FS(context.Background()), "a.txt", "dir/b.txt", "dir/sub/c.txt", "empty"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fsys.Create("new"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Create: got %v, want %v", err, fs.ErrPermission)
+	}
+}
+
+func TestViewFS(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, file := range []string{"pub/a", "pub/sub/b", "priv/c", "top"} {
+		p := filepath.Join(d, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New()
+	fsys := NewDirectory(d)
+	if err := s.AddFileSystem(fsys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fsys.String(), AllowSubtree(allowAll(okay.New()), "/pub")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fsys.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs := v.FS(context.Background())
+	if err := fstest.TestFS(vfs, "pub/a", "pub/sub/b"); err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"top", "priv/c", "priv"} {
+		if _, err := fs.ReadFile(vfs, name); !errors.Is(err, ErrNoAccess) {
+			t.Errorf("ReadFile(%q): got %v, want %v", name, err, ErrNoAccess)
+		}
+	}
+	v.Conceal = true
+	if _, err := fs.Stat(v.FS(context.Background()), "top"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("concealed Stat: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := vfs.Open("../pub/a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open(../pub/a): got %v, want %v", err, fs.ErrInvalid)
+	}
+}
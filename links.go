@@ -0,0 +1,203 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrLinkRefused is returned when a path leads through a symbolic link
+	// that the file system's LinkPolicy does not allow it to follow.
+	ErrLinkRefused = errors.New("symbolic link not followed")
+
+	// ErrLinkLoop is passed to a WalkFunc in place of a directory reached
+	// through a symbolic link that leads back to a directory being walked.
+	ErrLinkLoop = errors.New("symbolic link loop")
+)
+
+// A LinkFileSystem is a FileSystem that knows about symbolic links.
+type LinkFileSystem interface {
+	FileSystem
+
+	// Lstat should behave as os.Lstat: if path is a symbolic link, it
+	// describes the link rather than the file the link refers to.
+	Lstat(path string) (os.FileInfo, error)
+
+	// Readlink returns the destination of the symbolic link at path, as a
+	// path within the file system.  A relative destination is relative to
+	// the directory holding the link.
+	Readlink(path string) (string, error)
+}
+
+// A LinkPolicy says which symbolic links a directory follows.
+type LinkPolicy int
+
+const (
+	// FollowWithinRoot follows links only if they lead to somewhere beneath
+	// the directory's root.
+	FollowWithinRoot LinkPolicy = iota
+
+	// FollowLinks follows every link, wherever it leads.
+	FollowLinks
+
+	// RefuseLinks follows no links at all.
+	RefuseLinks
+)
+
+// maxLinks is the number of links realPath follows before giving up.
+const maxLinks = 255
+
+// realPath returns p, cleaned, with every symbolic link along it replaced by
+// its destination.
+func realPath(fs LinkFileSystem, p string) (string, error) {
+	rest := segments(cleanPath(p))
+	real := "/"
+	var links int
+	for len(rest) > 0 {
+		next := path.Join(real, rest[0])
+		rest = rest[1:]
+		fi, err := fs.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			real = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", &os.PathError{Op: "walk", Path: p, Err: ErrLinkLoop}
+		}
+		dest, err := fs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(dest) {
+			dest = path.Join(real, dest)
+		}
+		rest = append(segments(cleanPath(dest)), rest...)
+		real = "/"
+	}
+	return real, nil
+}
+
+// resolve returns the local path for path beneath root, having checked it
+// against the given policy.  The check is made before the path is used, so a
+// link that changes in between can still lead elsewhere.
+func resolve(root string, links LinkPolicy, op, p string) (string, error) {
+	full := absPath(root, p)
+	switch links {
+	case FollowLinks:
+		return full, nil
+	case RefuseLinks:
+		cur := root
+		for _, s := range segments(cleanPath(p)) {
+			cur = filepath.Join(cur, s)
+			fi, err := os.Lstat(cur)
+			if err != nil {
+				// Let the caller discover that it doesn't exist.
+				break
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return "", &os.PathError{Op: op, Path: p, Err: ErrLinkRefused}
+			}
+		}
+		return full, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if os.IsNotExist(err) {
+		// The file may be about to be created, so check where its
+		// directory is instead; but a dangling link can't be checked.
+		if fi, err := os.Lstat(full); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", &os.PathError{Op: op, Path: p, Err: ErrLinkRefused}
+		}
+		var dir string
+		dir, err = filepath.EvalSymlinks(filepath.Dir(full))
+		real = filepath.Join(dir, filepath.Base(full))
+	}
+	if err != nil {
+		return "", err
+	}
+	if !within(real, realRoot) {
+		return "", &os.PathError{Op: op, Path: p, Err: ErrLinkRefused}
+	}
+	return real, nil
+}
+
+// within reports whether the local path p is dir or beneath it.
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// lstat and readlink implement LinkFileSystem for local directories.  The
+// link itself is not followed, but the directories leading to it are
+// subject to the policy.
+func lstat(root string, links LinkPolicy, p string) (os.FileInfo, error) {
+	full, err := linkPath(root, links, "lstat", p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(full)
+}
+
+func readlink(root string, links LinkPolicy, p string) (string, error) {
+	full, err := linkPath(root, links, "readlink", p)
+	if err != nil {
+		return "", err
+	}
+	dest, err := os.Readlink(full)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dest) {
+		return filepath.ToSlash(dest), nil
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range []string{root, realRoot} {
+		if within(dest, r) {
+			rel, err := filepath.Rel(r, dest)
+			if err != nil {
+				return "", err
+			}
+			return cleanPath(rel), nil
+		}
+	}
+	return "", &os.PathError{Op: "readlink", Path: p, Err: ErrLinkRefused}
+}
+
+func linkPath(root string, links LinkPolicy, op, p string) (string, error) {
+	c := cleanPath(p)
+	if c == "/" {
+		return root, nil
+	}
+	dir, err := resolve(root, links, op, path.Dir(c))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(c)), nil
+}
@@ -0,0 +1,371 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSizeLimit is returned when a write to a Memory would exceed one of its
+// size limits.
+var ErrSizeLimit = errors.New("size limit exceeded")
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+	errFull   = errors.New("directory not empty")
+)
+
+// memories numbers Memory file systems, so that each has a distinct name.
+var memories int64
+
+// NewMemory returns an empty file system held in memory.
+func NewMemory() *Memory {
+	return &Memory{
+		name: fmt.Sprintf("memory-%d", atomic.AddInt64(&memories, 1)),
+		root: newMemDir(time.Now()),
+	}
+}
+
+// Memory is a FileSystem held in memory.  It is safe for concurrent use.
+//
+// Files written with Create appear, empty, as soon as they are created, but
+// their contents are replaced only when the writer is closed, so that
+// readers never see a partly written file.
+type Memory struct {
+	// MaxFileSize, if positive, limits the size of each file.
+	MaxFileSize int64
+
+	// MaxSize, if positive, limits the total size of all files.
+	MaxSize int64
+
+	name string
+	mu   sync.RWMutex
+	root *memNode
+	size int64
+}
+
+type memNode struct {
+	dir   bool
+	data  []byte // never modified once set, so readers may keep it
+	mtime time.Time
+	kids  map[string]*memNode
+}
+
+func newMemDir(mtime time.Time) *memNode {
+	return &memNode{dir: true, mtime: mtime, kids: make(map[string]*memNode)}
+}
+
+// String returns a name unique among the process's Memory file systems.
+func (m *Memory) String() string { return m.name }
+
+// lookup returns the node at the clean path p.  m.mu must be held.
+func (m *Memory) lookup(op, p string) (*memNode, error) {
+	n := m.root
+	for _, s := range segments(p) {
+		if !n.dir {
+			return nil, &os.PathError{Op: op, Path: p, Err: errNotDir}
+		}
+		k, ok := n.kids[s]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+		}
+		n = k
+	}
+	return n, nil
+}
+
+// parent returns the directory holding the clean path p, which must not be
+// the root.  m.mu must be held.
+func (m *Memory) parent(op, p string) (*memNode, string, error) {
+	segs := segments(p)
+	if len(segs) == 0 {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: errIsDir}
+	}
+	dir, err := m.lookup(op, "/"+strings.Join(segs[:len(segs)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.dir {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: errNotDir}
+	}
+	return dir, segs[len(segs)-1], nil
+}
+
+// Open returns a reader for the contents of the given file as they were when
+// it was opened.
+func (m *Memory) Open(path string) (io.ReadCloser, error) {
+	p := cleanPath(path)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookup("open", p)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errIsDir}
+	}
+	return memReader{bytes.NewReader(n.data)}, nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// Create returns a writer for the given path, whose directory must exist.
+// An existing file is replaced when the writer is closed.  If the file is
+// removed before then, Close discards what was written and returns an error.
+func (m *Memory) Create(path string) (io.WriteCloser, error) {
+	p := cleanPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, name, err := m.parent("open", p)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := dir.kids[name]
+	if ok && n.dir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errIsDir}
+	}
+	if !ok {
+		n = &memNode{mtime: time.Now()}
+		dir.kids[name] = n
+		dir.mtime = n.mtime
+	}
+	return &memWriter{m: m, dir: dir, name: name, n: n, path: p}, nil
+}
+
+type memWriter struct {
+	m      *Memory
+	dir    *memNode
+	name   string
+	n      *memNode
+	path   string
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *memWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, &os.PathError{Op: "write", Path: w.path, Err: os.ErrClosed}
+	}
+	if err := w.m.fits(w.n, int64(w.buf.Len()+len(b))); err != nil {
+		return 0, &os.PathError{Op: "write", Path: w.path, Err: err}
+	}
+	return w.buf.Write(b)
+}
+
+func (w *memWriter) Close() error {
+	if w.closed {
+		return &os.PathError{Op: "close", Path: w.path, Err: os.ErrClosed}
+	}
+	w.closed = true
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	if w.dir.kids[w.name] != w.n {
+		// The file was removed while it was being written.
+		return &os.PathError{Op: "close", Path: w.path, Err: os.ErrNotExist}
+	}
+	// Other writers may have grown the file system since the last Write.
+	if err := w.m.fitsLocked(w.n, int64(w.buf.Len())); err != nil {
+		return &os.PathError{Op: "close", Path: w.path, Err: err}
+	}
+	w.m.size += int64(w.buf.Len()) - int64(len(w.n.data))
+	w.n.data = w.buf.Bytes()
+	w.n.mtime = time.Now()
+	return nil
+}
+
+// fits reports whether n may hold size bytes.
+func (m *Memory) fits(n *memNode, size int64) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fitsLocked(n, size)
+}
+
+func (m *Memory) fitsLocked(n *memNode, size int64) error {
+	if m.MaxFileSize > 0 && size > m.MaxFileSize {
+		return ErrSizeLimit
+	}
+	if m.MaxSize > 0 && m.size-int64(len(n.data))+size > m.MaxSize {
+		return ErrSizeLimit
+	}
+	return nil
+}
+
+// Stat describes the given file or directory.
+func (m *Memory) Stat(path string) (os.FileInfo, error) {
+	p := cleanPath(path)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookup("stat", p)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(baseName(p)), nil
+}
+
+// ReadDir describes the entries of the given directory, in no particular
+// order.
+func (m *Memory) ReadDir(path string) ([]os.FileInfo, error) {
+	p := cleanPath(path)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, err := m.lookup("open", p)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: errNotDir}
+	}
+	fis := make([]os.FileInfo, 0, len(n.kids))
+	for name, k := range n.kids {
+		fis = append(fis, k.info(name))
+	}
+	return fis, nil
+}
+
+func baseName(p string) string {
+	segs := segments(p)
+	if len(segs) == 0 {
+		return "/"
+	}
+	return segs[len(segs)-1]
+}
+
+// Mkdir creates a directory, whose parent must exist.
+func (m *Memory) Mkdir(path string) error {
+	p := cleanPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, name, err := m.parent("mkdir", p)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.kids[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	dir.kids[name] = newMemDir(time.Now())
+	dir.mtime = dir.kids[name].mtime
+	return nil
+}
+
+// MkdirAll creates a directory and any of its parents that are missing.
+func (m *Memory) MkdirAll(path string) error {
+	p := cleanPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.root
+	for _, s := range segments(p) {
+		k, ok := n.kids[s]
+		if !ok {
+			k = newMemDir(time.Now())
+			n.kids[s] = k
+			n.mtime = k.mtime
+		}
+		if !k.dir {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+		}
+		n = k
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory.
+func (m *Memory) Remove(path string) error {
+	p := cleanPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, name, err := m.parent("remove", p)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.kids[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if n.dir && len(n.kids) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: errFull}
+	}
+	m.size -= int64(len(n.data))
+	delete(dir.kids, name)
+	dir.mtime = time.Now()
+	return nil
+}
+
+// Size returns the total size of the files in m.
+func (m *Memory) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+// Snapshot returns a copy of m as it is now, with a name of its own and the
+// same limits.  Changes to either do not affect the other.  File contents
+// are shared rather than copied, so snapshots are cheap.
+func (m *Memory) Snapshot() *Memory {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := NewMemory()
+	s.MaxFileSize, s.MaxSize = m.MaxFileSize, m.MaxSize
+	s.root = m.root.copy()
+	s.size = m.size
+	return s
+}
+
+func (n *memNode) copy() *memNode {
+	c := &memNode{dir: n.dir, data: n.data, mtime: n.mtime}
+	if n.dir {
+		c.kids = make(map[string]*memNode, len(n.kids))
+		for name, k := range n.kids {
+			c.kids[name] = k.copy()
+		}
+	}
+	return c
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return memInfo{name: name, size: int64(len(n.data)), mtime: n.mtime, dir: n.dir}
+}
+
+type memInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.mtime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+func (i memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,288 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+)
+
+func writeMem(t *testing.T, m *Memory, path, data string) {
+	t.Helper()
+	w, err := m.Create(path)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", path, err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("Create(%q): write: %v", path, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Create(%q): close: %v", path, err)
+	}
+}
+
+func readMem(m *Memory, path string) (string, error) {
+	r, err := m.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func TestMemoryDirs(t *testing.T) {
+	m := NewMemory()
+	if NewMemory().String() == m.String() {
+		t.Errorf("two Memory file systems have the name %q", m.String())
+	}
+	if _, err := m.Create("reports/q1"); !os.IsNotExist(err) {
+		t.Errorf("Create in a missing directory: got %v, want not found", err)
+	}
+	if err := m.MkdirAll("reports/2017"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mkdir("reports"); !os.IsExist(err) {
+		t.Errorf("Mkdir of an existing directory: got %v, want exists", err)
+	}
+	writeMem(t, m, "reports/2017/q1", "q1")
+	writeMem(t, m, "reports/summary", "all")
+	if err := m.Mkdir("reports/summary/sub"); err == nil {
+		t.Errorf("Mkdir beneath a file: got no error")
+	}
+	if _, err := m.Create("reports"); err == nil {
+		t.Errorf("Create of a directory: got no error")
+	}
+	if _, err := m.Open("reports"); err == nil {
+		t.Errorf("Open of a directory: got no error")
+	}
+
+	fis, err := m.ReadDir("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range fis {
+		got = append(got, fi.Name())
+	}
+	sort.Strings(got)
+	if want := []string{"2017", "summary"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir: got %v, want %v", got, want)
+	}
+
+	if err := m.Remove("reports/2017"); err == nil {
+		t.Errorf("Remove of a non-empty directory: got no error")
+	}
+	if err := m.Remove("reports/2017/q1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("reports/2017"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("reports/2017"); !os.IsNotExist(err) {
+		t.Errorf("Stat after Remove: got %v, want not found", err)
+	}
+	if got := m.Size(); got != 3 {
+		t.Errorf("Size: got %d, want 3", got)
+	}
+}
+
+func TestMemoryWrites(t *testing.T) {
+	m := NewMemory()
+	writeMem(t, m, "f", "old")
+	fi, err := m.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := fi.ModTime()
+
+	time.Sleep(time.Millisecond)
+	w, err := m.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "new contents")
+	if got, _ := readMem(m, "f"); got != "old" {
+		t.Errorf("read during write: got %q, want %q", got, "old")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readMem(m, "f"); got != "new contents" {
+		t.Errorf("read after write: got %q, want %q", got, "new contents")
+	}
+	fi, err = m.Stat("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().After(before) || fi.Size() != int64(len("new contents")) {
+		t.Errorf("Stat after write: got mtime %v, size %d; want after %v, size %d", fi.ModTime(), fi.Size(), before, len("new contents"))
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Errorf("Write after Close: got no error")
+	}
+
+	// A file removed while it is written stays removed, and Close says so.
+	w, err = m.Create("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "gone")
+	if err := m.Remove("g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !os.IsNotExist(err) {
+		t.Errorf("Close of a removed file: got %v, want not found", err)
+	}
+	if _, err := m.Stat("g"); !os.IsNotExist(err) || m.Size() != int64(len("new contents")) {
+		t.Errorf("after writing a removed file: got %v and size %d", err, m.Size())
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	m := NewMemory()
+	m.MaxFileSize = 10
+	m.MaxSize = 15
+
+	w, err := m.Create("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 11)); !isSizeLimit(err) {
+		t.Errorf("write past MaxFileSize: got %v, want %v", err, ErrSizeLimit)
+	}
+	w.Close()
+
+	writeMem(t, m, "a", "0123456789")
+	w, err = m.Create("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 6)); !isSizeLimit(err) {
+		t.Errorf("write past MaxSize: got %v, want %v", err, ErrSizeLimit)
+	}
+	w.Close()
+
+	// Replacing a file counts only the difference.
+	writeMem(t, m, "a", "01234")
+	writeMem(t, m, "b", "0123456789")
+
+	// Two writers that each fit, but not together.
+	w1, _ := m.Create("c")
+	w2, _ := m.Create("d")
+	m.MaxSize = 20
+	if _, err := w1.Write(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.Write(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.Close(); !isSizeLimit(err) {
+		t.Errorf("second writer: got %v, want %v", err, ErrSizeLimit)
+	}
+}
+
+func isSizeLimit(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == ErrSizeLimit
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	m := NewMemory()
+	if err := m.MkdirAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	writeMem(t, m, "dir/a", "before")
+
+	s := m.Snapshot()
+	if s.String() == m.String() {
+		t.Errorf("snapshot has its parent's name %q", s.String())
+	}
+	writeMem(t, m, "dir/a", "after")
+	writeMem(t, m, "dir/b", "new")
+	writeMem(t, s, "dir/c", "snap")
+
+	table := []struct {
+		fs   *Memory
+		path string
+		want string
+	}{
+		{m, "dir/a", "after"},
+		{m, "dir/b", "new"},
+		{m, "dir/c", ""},
+		{s, "dir/a", "before"},
+		{s, "dir/b", ""},
+		{s, "dir/c", "snap"},
+	}
+	for _, ent := range table {
+		got, err := readMem(ent.fs, ent.path)
+		if ent.want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: %s: got %q, %v; want not found", ent.fs, ent.path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != ent.want {
+			t.Errorf("%s: %s: got %q, %v; want %q", ent.fs, ent.path, got, err, ent.want)
+		}
+	}
+}
+
+func TestMemoryThroughView(t *testing.T) {
+	m := NewMemory()
+	if err := m.MkdirAll("pub/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MkdirAll("priv"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"pub/a", "pub/sub/b", "priv/c"} {
+		writeMem(t, m, p, p)
+	}
+
+	s := New()
+	if err := s.AddFileSystem(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(m.String(), AllowSubtree(allowAll(okay.New()), "/pub")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	files, _, err := v.List(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pub/a", "pub/sub/b"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("List: got %v, want %v", files, want)
+	}
+	if _, err := v.Open(ctx, "priv/c"); err != ErrNoAccess {
+		t.Errorf("Open(priv/c): got %v, want %v", err, ErrNoAccess)
+	}
+}
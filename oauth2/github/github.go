@@ -17,39 +17,64 @@ package github
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/okay"
-	"github.com/gorilla/securecookie"
+	"github.com/kurin/visage/oauth2/session"
+	"github.com/kurin/visage/provider"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
-var sc *securecookie.SecureCookie
-
-func init() {
-	hashKey := securecookie.GenerateRandomKey(64)
-	blockKey := securecookie.GenerateRandomKey(32)
-	if hashKey == nil || blockKey == nil {
-		panic("couldn't generate random key")
-	}
-	sc = securecookie.New(hashKey, blockKey)
-}
-
 type ctxKey int
 
 const oauthToken ctxKey = 0
 
-const githubEndpoint = "https://api.github.com/user"
+const (
+	githubEndpoint = "https://api.github.com/user"
+	orgsEndpoint   = "https://api.github.com/user/orgs?per_page=100"
+	teamsEndpoint  = "https://api.github.com/user/teams?per_page=100"
+)
 
 type access struct {
 	Login string `json:"login"`
+
+	// Orgs and Teams are resolved at sign-in.  Teams are named
+	// "org/team-slug".  Both are lower case.
+	Orgs  []string `json:"orgs,omitempty"`
+	Teams []string `json:"teams,omitempty"`
+}
+
+func verify(ok okay.OK, match func(*access) bool) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		acc, ok := ctx.Value(oauthToken).(*access)
+		if !ok {
+			return false, nil
+		}
+		return match(acc), nil
+	})
+}
+
+func set(vals []string) map[string]bool {
+	m := make(map[string]bool)
+	for _, v := range vals {
+		m[strings.ToLower(v)] = true
+	}
+	return m
+}
+
+func anyOf(allowed map[string]bool, vals []string) bool {
+	for _, v := range vals {
+		if allowed[v] {
+			return true
+		}
+	}
+	return false
 }
 
 // VerifyLogin returns an OK that will verify users by their GitHub login.
@@ -58,12 +83,26 @@ func VerifyLogin(ok okay.OK, logins ...string) okay.OK {
 	for _, l := range logins {
 		allowed[l] = true
 	}
-	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
-		acc, ok := ctx.Value(oauthToken).(*access)
-		if !ok {
-			return false, nil
-		}
-		return allowed[acc.Login], nil
+	return verify(ok, func(acc *access) bool {
+		return allowed[acc.Login]
+	})
+}
+
+// VerifyOrg returns an OK that will verify members of any of the given
+// GitHub organizations.
+func VerifyOrg(ok okay.OK, orgs ...string) okay.OK {
+	allowed := set(orgs)
+	return verify(ok, func(acc *access) bool {
+		return anyOf(allowed, acc.Orgs)
+	})
+}
+
+// VerifyTeam returns an OK that will verify members of any of the given
+// GitHub teams, each named "org/team-slug".
+func VerifyTeam(ok okay.OK, teams ...string) okay.OK {
+	allowed := set(teams)
+	return verify(ok, func(acc *access) bool {
+		return anyOf(allowed, acc.Teams)
 	})
 }
 
@@ -72,27 +111,94 @@ type Config struct {
 	ClientSecret string
 	RedirectURI  string
 	LogoutPath   string
+
+	// SessionTTL and Keys are the TTL and Keys of the sign-in's
+	// session.Flow.
+	SessionTTL time.Duration
+	Keys       []session.KeyPair
+
+	sessions *session.Manager
+}
+
+var _ provider.Provider = (*Config)(nil)
+
+// Name returns "github".
+func (c *Config) Name() string { return "github" }
+
+// Title returns "GitHub".
+func (c *Config) Title() string { return "GitHub" }
+
+// LogoutURL returns the configured LogoutPath.
+func (c *Config) LogoutURL() string { return c.LogoutPath }
+
+// Context returns a context that is updated with the identity from the
+// request's session, if it has one.  The identity is resolved when the user
+// signs in, and again only when the access token must be refreshed.
+func (c *Config) Context(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := ctx.Value(oauthToken).(*access); ok {
+		return ctx
+	}
+	if c.sessions == nil {
+		return ctx
+	}
+	b, ok := c.sessions.Get(ctx, r)
+	if !ok {
+		return ctx
+	}
+	acc := &access{}
+	if err := json.Unmarshal(b, acc); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauthToken, acc)
+}
+
+// Show calls the package-level Show.
+func (c *Config) Show(ctx context.Context) (string, bool) { return Show(ctx) }
+
+// Verify returns an OK that verifies users matching any of the given
+// principals.  A principal may be
+//
+//	org/<org>
+//	team/<org>/<team-slug>
+//
+// and anything else is taken to be a login.
+func (c *Config) Verify(ok okay.OK, principals ...string) okay.OK {
+	for _, p := range principals {
+		switch {
+		case strings.HasPrefix(p, "org/"):
+			ok = VerifyOrg(ok, strings.TrimPrefix(p, "org/"))
+		case strings.HasPrefix(p, "team/"):
+			ok = VerifyTeam(ok, strings.TrimPrefix(p, "team/"))
+		default:
+			ok = VerifyLogin(ok, p)
+		}
+	}
+	return ok
 }
 
 // RegisterHandlers registers GitHub authentication handlers.  The given path
 // is the landing URL to begin the sign-in flow, and the return handler
-// is registered at the URL listed in the config.
-func (c *Config) RegisterHandlers(path string) error {
+// is registered at the URL listed in the config.  Handlers are registered on
+// the given mux, and users are sent to home after signing in or out.
+func (c *Config) RegisterHandlers(mux *http.ServeMux, path, home string) error {
 	cfg := &oauth2.Config{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		Endpoint:     github.Endpoint,
 		RedirectURL:  c.RedirectURI,
-		Scopes:       []string{"user:email"},
+		Scopes:       []string{"user:email", "read:org"},
 	}
-	http.HandleFunc(path, loginHandler(cfg))
-	r, err := url.Parse(c.RedirectURI)
-	if err != nil {
-		return err
+	f := &session.Flow{
+		Config:        cfg,
+		Resolve:       resolve,
+		SessionCookie: tokenCookie,
+		StateCookie:   stateCookie,
+		TTL:           c.SessionTTL,
+		Keys:          c.Keys,
 	}
-	http.HandleFunc(r.Path, loginReturnHandler(cfg))
-	http.HandleFunc(c.LogoutPath, logoutHandler)
-	return nil
+	var err error
+	c.sessions, err = f.Register(mux, path, c.LogoutPath, home)
+	return err
 }
 
 const (
@@ -100,104 +206,77 @@ const (
 	stateCookie = "github-oauth-state"
 )
 
-// Context returns a context that is updated with a GitHub authentication
-// token from the given HTTP request, if it exists.
-func Context(ctx context.Context, r *http.Request) context.Context {
-	if _, ok := ctx.Value(oauthToken).(*access); ok {
-		return ctx
-	}
-	c, err := r.Cookie(tokenCookie)
-	if err != nil {
-		return ctx
-	}
-	var tok oauth2.Token
-	if err := sc.Decode(tokenCookie, c.Value, &tok); err != nil {
-		return ctx
-	}
-	resp, err := http.Get(fmt.Sprintf("%s?access_token=%s", githubEndpoint, tok.AccessToken))
-	if err != nil {
-		return ctx
-	}
-	defer resp.Body.Close()
-	dec := json.NewDecoder(resp.Body)
+// resolve fetches the identity of the signed-in user, along with their
+// organizations and teams.
+func resolve(ctx context.Context, client *http.Client) ([]byte, error) {
 	acc := &access{}
-	if err := dec.Decode(acc); err != nil {
-		return ctx
+	if _, err := get(client, githubEndpoint, acc); err != nil {
+		return nil, err
 	}
 	if acc.Login == "" {
-		return ctx
-	}
-	return context.WithValue(ctx, oauthToken, acc)
-}
-
-func loginHandler(config *oauth2.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		state := fmt.Sprintf("%x", sha1.Sum(b))
-		code, err := sc.Encode(stateCookie, state)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:  stateCookie,
-			Value: code,
-		})
-		rURL := config.AuthCodeURL(state)
-		http.Redirect(w, r, rURL, http.StatusTemporaryRedirect)
+		return nil, fmt.Errorf("github: userinfo: no login")
 	}
-}
-
-func loginReturnHandler(config *oauth2.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie(stateCookie)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	for next := orgsEndpoint; next != ""; {
+		var orgs []struct {
+			Login string `json:"login"`
 		}
-		var state string
-		if err := sc.Decode(stateCookie, c.Value, &state); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		var err error
+		if next, err = get(client, next, &orgs); err != nil {
+			return nil, err
 		}
-		rState := r.FormValue("state")
-		if rState != state {
-			http.Error(w, "oauth2 state mismatch", http.StatusBadRequest)
-			return
+		for _, o := range orgs {
+			acc.Orgs = append(acc.Orgs, strings.ToLower(o.Login))
 		}
-		code := r.FormValue("code")
-		token, err := config.Exchange(oauth2.NoContext, code)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	}
+	for next := teamsEndpoint; next != ""; {
+		var teams []struct {
+			Slug string `json:"slug"`
+			Org  struct {
+				Login string `json:"login"`
+			} `json:"organization"`
 		}
-		enc, err := sc.Encode(tokenCookie, token)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		var err error
+		if next, err = get(client, next, &teams); err != nil {
+			return nil, err
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:  tokenCookie,
-			Value: enc,
-		})
-		rURI := r.FormValue("redirect_uri")
-		if rURI == "" {
-			rURI = "/"
+		for _, t := range teams {
+			acc.Teams = append(acc.Teams, strings.ToLower(t.Org.Login+"/"+t.Slug))
 		}
-		http.Redirect(w, r, rURI, http.StatusTemporaryRedirect)
 	}
+	return json.Marshal(acc)
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   tokenCookie,
-		MaxAge: -1,
-	})
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+// get decodes the JSON at u into v, and returns the URL of the next page
+// of results, if any.
+func get(client *http.Client, u string, v interface{}) (string, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("github: %s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+	return nextLink(resp.Header.Get("Link")), nil
+}
+
+// nextLink returns the rel="next" URL from a Link header.
+func nextLink(h string) string {
+	for _, l := range strings.Split(h, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
 }
 
 // Show reports the value of the verified credentials, if any.
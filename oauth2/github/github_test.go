@@ -0,0 +1,69 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package github
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/okay"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.WithValue(context.Background(), oauthToken, &access{
+		Login: "kurin",
+		Orgs:  []string{"myorg"},
+		Teams: []string{"myorg/infra"},
+	})
+	table := []struct {
+		principal string
+		want      bool
+	}{
+		{"kurin", true},
+		{"someone", false},
+		{"org/myorg", true},
+		{"org/MyOrg", true},
+		{"org/otherorg", false},
+		{"team/myorg/infra", true},
+		{"team/myorg/finance", false},
+		{"team/otherorg/infra", false},
+	}
+	cfg := &Config{}
+	for _, ent := range table {
+		got, err := cfg.Verify(okay.New(), ent.principal).Verify(ctx)
+		if err != nil {
+			t.Errorf("Verify(%q): %v", ent.principal, err)
+			continue
+		}
+		if got != ent.want {
+			t.Errorf("Verify(%q): got %v, want %v", ent.principal, got, ent.want)
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	table := []struct {
+		header, want string
+	}{
+		{"", ""},
+		{`<https://api.github.com/user/orgs?page=2>; rel="next", <https://api.github.com/user/orgs?page=5>; rel="last"`, "https://api.github.com/user/orgs?page=2"},
+		{`<https://api.github.com/user/orgs?page=1>; rel="prev"`, ""},
+	}
+	for _, ent := range table {
+		if got := nextLink(ent.header); got != ent.want {
+			t.Errorf("nextLink(%q): got %q, want %q", ent.header, got, ent.want)
+		}
+	}
+}
@@ -17,31 +17,20 @@ package google
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/okay"
-	"github.com/gorilla/securecookie"
+	"github.com/kurin/visage/oauth2/session"
+	"github.com/kurin/visage/provider"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
-var sc *securecookie.SecureCookie
-
-func init() {
-	hashKey := securecookie.GenerateRandomKey(64)
-	blockKey := securecookie.GenerateRandomKey(32)
-	if hashKey == nil || blockKey == nil {
-		panic("couldn't generate random key")
-	}
-	sc = securecookie.New(hashKey, blockKey)
-}
-
 const googleEndpoint = "https://www.googleapis.com/oauth2/v2/userinfo"
 
 type ctxKey int
@@ -51,6 +40,27 @@ const oauthToken ctxKey = 0
 type access struct {
 	Email    string `json:"email"`
 	Verified bool   `json:"verified_email"`
+
+	// HostedDomain is set for Google Workspace accounts.
+	HostedDomain string `json:"hd,omitempty"`
+}
+
+func verify(ok okay.OK, match func(*access) bool) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		acc, ok := ctx.Value(oauthToken).(*access)
+		if !ok {
+			return false, nil
+		}
+		return match(acc), nil
+	})
+}
+
+func domains(ds []string) map[string]bool {
+	m := make(map[string]bool)
+	for _, d := range ds {
+		m[strings.ToLower(strings.TrimPrefix(d, "@"))] = true
+	}
+	return m
 }
 
 // VerifyEmail returns an OK that will verify users whose Google account is
@@ -60,12 +70,32 @@ func VerifyEmail(ok okay.OK, emails ...string) okay.OK {
 	for _, mail := range emails {
 		allowed[mail] = true
 	}
-	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
-		acc, ok := ctx.Value(oauthToken).(*access)
-		if !ok {
-			return false, nil
+	return verify(ok, func(acc *access) bool {
+		return allowed[acc.Email] && acc.Verified
+	})
+}
+
+// VerifyEmailDomain returns an OK that will verify users whose verified
+// address is in any of the given domains, such as "example.com".
+func VerifyEmailDomain(ok okay.OK, ds ...string) okay.OK {
+	allowed := domains(ds)
+	return verify(ok, func(acc *access) bool {
+		i := strings.LastIndex(acc.Email, "@")
+		if i < 0 || !acc.Verified {
+			return false
 		}
-		return allowed[acc.Email] && acc.Verified, nil
+		return allowed[strings.ToLower(acc.Email[i+1:])]
+	})
+}
+
+// VerifyHostedDomain returns an OK that will verify users whose account
+// belongs to any of the given Google Workspace domains.  Unlike
+// VerifyEmailDomain, this relies on the account's hosted domain, which
+// consumer accounts with a matching address do not have.
+func VerifyHostedDomain(ok okay.OK, ds ...string) okay.OK {
+	allowed := domains(ds)
+	return verify(ok, func(acc *access) bool {
+		return acc.HostedDomain != "" && allowed[strings.ToLower(acc.HostedDomain)]
 	})
 }
 
@@ -74,12 +104,76 @@ type Config struct {
 	ClientSecret string
 	RedirectURI  string
 	LogoutPath   string
+
+	// SessionTTL and Keys are the TTL and Keys of the sign-in's
+	// session.Flow.
+	SessionTTL time.Duration
+	Keys       []session.KeyPair
+
+	sessions *session.Manager
+}
+
+var _ provider.Provider = (*Config)(nil)
+
+// Name returns "google".
+func (c *Config) Name() string { return "google" }
+
+// Title returns "Google".
+func (c *Config) Title() string { return "Google" }
+
+// LogoutURL returns the configured LogoutPath.
+func (c *Config) LogoutURL() string { return c.LogoutPath }
+
+// Context returns a context that is updated with the identity from the
+// request's session, if it has one.  The identity is resolved when the user
+// signs in, and again only when the access token must be refreshed.
+func (c *Config) Context(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := ctx.Value(oauthToken).(*access); ok {
+		return ctx
+	}
+	if c.sessions == nil {
+		return ctx
+	}
+	b, ok := c.sessions.Get(ctx, r)
+	if !ok {
+		return ctx
+	}
+	acc := &access{}
+	if err := json.Unmarshal(b, acc); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauthToken, acc)
+}
+
+// Show calls the package-level Show.
+func (c *Config) Show(ctx context.Context) (string, bool) { return Show(ctx) }
+
+// Verify returns an OK that verifies users matching any of the given
+// principals.  A principal may be
+//
+//	@<domain>
+//	hd/<domain>
+//
+// and anything else is taken to be an email address.
+func (c *Config) Verify(ok okay.OK, principals ...string) okay.OK {
+	for _, p := range principals {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			ok = VerifyEmailDomain(ok, p)
+		case strings.HasPrefix(p, "hd/"):
+			ok = VerifyHostedDomain(ok, strings.TrimPrefix(p, "hd/"))
+		default:
+			ok = VerifyEmail(ok, p)
+		}
+	}
+	return ok
 }
 
 // RegisterHandlers registers Google Sign-In handlers.  The given path
 // is the landing URL to begin the sign-in flow, and the return handler
-// is registered at the URL listed in the config.
-func (c *Config) RegisterHandlers(path string) error {
+// is registered at the URL listed in the config.  Handlers are registered on
+// the given mux, and users are sent to home after signing in or out.
+func (c *Config) RegisterHandlers(mux *http.ServeMux, path, home string) error {
 	cfg := &oauth2.Config{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
@@ -87,14 +181,18 @@ func (c *Config) RegisterHandlers(path string) error {
 		Scopes:       []string{"email"},
 		RedirectURL:  c.RedirectURI,
 	}
-	http.HandleFunc(path, loginHandler(cfg))
-	r, err := url.Parse(c.RedirectURI)
-	if err != nil {
-		return err
+	f := &session.Flow{
+		Config:        cfg,
+		Resolve:       resolve,
+		SessionCookie: tokenCookie,
+		StateCookie:   stateCookie,
+		Options:       []oauth2.AuthCodeOption{oauth2.AccessTypeOffline},
+		TTL:           c.SessionTTL,
+		Keys:          c.Keys,
 	}
-	http.HandleFunc(r.Path, loginReturnHandler(cfg))
-	http.HandleFunc(c.LogoutPath, logoutHandler)
-	return nil
+	var err error
+	c.sessions, err = f.Register(mux, path, c.LogoutPath, home)
+	return err
 }
 
 const (
@@ -102,104 +200,24 @@ const (
 	stateCookie = "goog-oauth-state"
 )
 
-// Context returns a context that is updated with a Google Sign-In
-// token from the given HTTP request, if it exists.
-func Context(ctx context.Context, r *http.Request) context.Context {
-	if _, ok := ctx.Value(oauthToken).(*access); ok {
-		return ctx
-	}
-	c, err := r.Cookie(tokenCookie)
-	if err != nil {
-		return ctx
-	}
-	var tok oauth2.Token
-	if err := sc.Decode(tokenCookie, c.Value, &tok); err != nil {
-		return ctx
-	}
-	resp, err := http.Get(fmt.Sprintf("%s?access_token=%s", googleEndpoint, tok.AccessToken))
+// resolve fetches the identity of the signed-in user.
+func resolve(ctx context.Context, client *http.Client) ([]byte, error) {
+	resp, err := client.Get(googleEndpoint)
 	if err != nil {
-		return ctx
+		return nil, err
 	}
 	defer resp.Body.Close()
-	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google: userinfo: %s", resp.Status)
+	}
 	acc := &access{}
-	if err := dec.Decode(acc); err != nil {
-		return ctx
+	if err := json.NewDecoder(resp.Body).Decode(acc); err != nil {
+		return nil, err
 	}
 	if acc.Email == "" {
-		return ctx
+		return nil, fmt.Errorf("google: userinfo: no email")
 	}
-	return context.WithValue(ctx, oauthToken, acc)
-}
-
-func loginHandler(config *oauth2.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		state := fmt.Sprintf("%x", sha1.Sum(b))
-		code, err := sc.Encode(stateCookie, state)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:  stateCookie,
-			Value: code,
-		})
-		rURL := config.AuthCodeURL(state)
-		http.Redirect(w, r, rURL, http.StatusTemporaryRedirect)
-	}
-}
-
-func loginReturnHandler(config *oauth2.Config) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie(stateCookie)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		var state string
-		if err := sc.Decode(stateCookie, c.Value, &state); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		rState := r.FormValue("state")
-		if rState != state {
-			http.Error(w, "oauth2 state mismatch", http.StatusBadRequest)
-			return
-		}
-		code := r.FormValue("code")
-		token, err := config.Exchange(oauth2.NoContext, code)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		enc, err := sc.Encode(tokenCookie, token)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:  tokenCookie,
-			Value: enc,
-		})
-		rURI := r.FormValue("redirect_uri")
-		if rURI == "" {
-			rURI = "/"
-		}
-		http.Redirect(w, r, rURI, http.StatusTemporaryRedirect)
-	}
-}
-
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   tokenCookie,
-		MaxAge: -1,
-	})
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	return json.Marshal(acc)
 }
 
 // Show reports the value of the verified credentials, if any.
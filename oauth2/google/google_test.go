@@ -0,0 +1,83 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package google
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/okay"
+)
+
+func TestVerify(t *testing.T) {
+	table := []struct {
+		acc       *access
+		principal string
+		want      bool
+	}{
+		{
+			acc:       &access{Email: "user@example.com", Verified: true},
+			principal: "user@example.com",
+			want:      true,
+		},
+		{
+			acc:       &access{Email: "user@example.com"},
+			principal: "user@example.com",
+		},
+		{
+			acc:       &access{Email: "user@example.com", Verified: true},
+			principal: "@example.com",
+			want:      true,
+		},
+		{
+			acc:       &access{Email: "user@Example.COM", Verified: true},
+			principal: "@example.com",
+			want:      true,
+		},
+		{
+			acc:       &access{Email: "user@example.com"},
+			principal: "@example.com",
+		},
+		{
+			acc:       &access{Email: "user@notexample.com", Verified: true},
+			principal: "@example.com",
+		},
+		{
+			acc:       &access{Email: "user@mail.example.com", Verified: true},
+			principal: "@example.com",
+		},
+		{
+			acc:       &access{Email: "user@example.com", Verified: true, HostedDomain: "example.com"},
+			principal: "hd/example.com",
+			want:      true,
+		},
+		{
+			acc:       &access{Email: "user@example.com", Verified: true},
+			principal: "hd/example.com",
+		},
+	}
+	cfg := &Config{}
+	for _, ent := range table {
+		ctx := context.WithValue(context.Background(), oauthToken, ent.acc)
+		got, err := cfg.Verify(okay.New(), ent.principal).Verify(ctx)
+		if err != nil {
+			t.Errorf("Verify(%q) for %v: %v", ent.principal, ent.acc, err)
+			continue
+		}
+		if got != ent.want {
+			t.Errorf("Verify(%q) for %v: got %v, want %v", ent.principal, ent.acc, got, ent.want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package oidc provides OKs and tokens for any OpenID Connect issuer, such as
+// Keycloak or Dex.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/okay"
+	"github.com/kurin/visage/oauth2/session"
+	"github.com/kurin/visage/provider"
+
+	"golang.org/x/oauth2"
+)
+
+type ctxKey string
+
+// Identity holds the verified claims from a user's ID token.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+
+	// Expiry is that of the most recently verified ID token.  A session
+	// outlasts it, verifying a new ID token whenever a refresh returns one.
+	Expiry time.Time
+
+	// Claims holds every claim in the ID token, decoded from JSON.
+	Claims map[string]interface{}
+}
+
+// Config describes an OpenID Connect issuer.
+type Config struct {
+	// Scheme is the name used for this issuer in grants, such as "dex".
+	// Each issuer in a process must have its own scheme.
+	Scheme string
+
+	// DisplayName is shown to users on the sign-in button.  It defaults to
+	// Scheme.
+	DisplayName string
+
+	// Issuer is the issuer URL.  Its .well-known/openid-configuration
+	// document is fetched when handlers are registered.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	LogoutPath   string
+
+	// Scopes are requested in addition to "openid".  If empty, "email" and
+	// "profile" are requested.  Many issuers return a refresh token only if
+	// "offline_access" is requested; without one, a sign-in lasts only as
+	// long as its access token.
+	Scopes []string
+
+	// GroupsClaim names the claim that lists a user's groups.  It defaults
+	// to "groups".
+	GroupsClaim string
+
+	// Client, if set, is used for discovery, key fetches, and token
+	// exchanges.
+	Client *http.Client
+
+	// SessionTTL and Keys are the TTL and Keys of the sign-in's
+	// session.Flow.
+	SessionTTL time.Duration
+	Keys       []session.KeyPair
+
+	sessions *session.Manager
+}
+
+var (
+	_ provider.Provider         = (*Config)(nil)
+	_ provider.PrincipalChecker = (*Config)(nil)
+)
+
+// Name returns the configured Scheme.
+func (c *Config) Name() string { return c.Scheme }
+
+// Title returns the configured DisplayName, or Scheme if it is unset.
+func (c *Config) Title() string {
+	if c.DisplayName != "" {
+		return c.DisplayName
+	}
+	return c.Scheme
+}
+
+// LogoutURL returns the configured LogoutPath.
+func (c *Config) LogoutURL() string { return c.LogoutPath }
+
+func (c *Config) tokenCookie() string { return "oidc-" + c.Scheme + "-token" }
+func (c *Config) stateCookie() string { return "oidc-" + c.Scheme + "-state" }
+
+func (c *Config) context(ctx context.Context) context.Context {
+	if c.Client != nil {
+		return gooidc.ClientContext(ctx, c.Client)
+	}
+	return ctx
+}
+
+// RegisterHandlers discovers the issuer's endpoints and registers the
+// sign-in handlers on mux.  The given path is the landing URL to begin the
+// sign-in flow, the return handler is registered at the URL listed in the
+// config, and users are sent to home after signing in or out.
+func (c *Config) RegisterHandlers(mux *http.ServeMux, path, home string) error {
+	if c.Scheme == "" {
+		return fmt.Errorf("oidc: %s: no scheme configured", c.Issuer)
+	}
+	p, err := gooidc.NewProvider(c.context(context.Background()), c.Issuer)
+	if err != nil {
+		return err
+	}
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	cfg := &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Endpoint:     p.Endpoint(),
+		RedirectURL:  c.RedirectURI,
+		Scopes:       append([]string{gooidc.ScopeOpenID}, scopes...),
+	}
+	f := &session.Flow{
+		Config:        cfg,
+		Resolve:       resolver(p.Verifier(&gooidc.Config{ClientID: c.ClientID})),
+		SessionCookie: c.tokenCookie(),
+		StateCookie:   c.stateCookie(),
+		Nonce:         true,
+		Client:        c.Client,
+		TTL:           c.SessionTTL,
+		Keys:          c.Keys,
+	}
+	c.sessions, err = f.Register(mux, path, c.LogoutPath, home)
+	return err
+}
+
+// idSession is the identity kept in the session: the claims of the most
+// recently verified ID token.
+type idSession struct {
+	Claims []byte
+	Expiry time.Time
+}
+
+// resolver returns a Resolver that verifies the ID token returned with each
+// access token, at sign-in and on every refresh, and keeps its claims.  At
+// sign-in, the ID token must carry the flow's nonce.  An ID token is
+// optional on refresh (OpenID Connect Core, section 12.2), so without one
+// the claims verified before are kept.
+func resolver(verifier *gooidc.IDTokenVerifier) session.Resolver {
+	return func(ctx context.Context, _ *http.Client) ([]byte, error) {
+		tok, ok := session.Token(ctx)
+		if !ok {
+			return nil, errors.New("oidc: no token to resolve")
+		}
+		raw, ok := tok.Extra("id_token").(string)
+		if !ok {
+			if prev, ok := session.Refreshing(ctx); ok {
+				return prev, nil
+			}
+			return nil, errors.New("oidc: no id_token in token response")
+		}
+		nonce, _ := session.Nonce(ctx)
+		sess, err := verify(ctx, verifier, raw, nonce)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(sess)
+	}
+}
+
+// verify checks the raw ID token's signature, issuer, audience, and expiry
+// with verifier, and that it carries the expected nonce, if one is given.
+func verify(ctx context.Context, verifier *gooidc.IDTokenVerifier, raw, nonce string) (*idSession, error) {
+	tok, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && tok.Nonce != nonce {
+		return nil, fmt.Errorf("oidc: nonce mismatch")
+	}
+	var claims json.RawMessage
+	if err := tok.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return &idSession{
+		Claims: claims,
+		Expiry: tok.Expiry,
+	}, nil
+}
+
+// Context returns a context that is updated with the identity from the
+// request's session, if it has one.  A session lasts for SessionTTL; when
+// its access token expires, it is refreshed and the new ID token verified.
+func (c *Config) Context(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := ctx.Value(ctxKey(c.Scheme)).(*Identity); ok {
+		return ctx
+	}
+	if c.sessions == nil {
+		return ctx
+	}
+	b, ok := c.sessions.Get(c.context(ctx), r)
+	if !ok {
+		return ctx
+	}
+	var sess idSession
+	if err := json.Unmarshal(b, &sess); err != nil {
+		return ctx
+	}
+	id, err := c.identity(sess)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKey(c.Scheme), id)
+}
+
+func (c *Config) identity(sess idSession) (*Identity, error) {
+	id := &Identity{Expiry: sess.Expiry}
+	if err := json.Unmarshal(sess.Claims, &id.Claims); err != nil {
+		return nil, err
+	}
+	id.Subject, _ = id.Claims["sub"].(string)
+	id.Email, _ = id.Claims["email"].(string)
+	id.EmailVerified, _ = id.Claims["email_verified"].(bool)
+	gc := c.GroupsClaim
+	if gc == "" {
+		gc = "groups"
+	}
+	switch g := id.Claims[gc].(type) {
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = []string{g}
+	}
+	return id, nil
+}
+
+// FromContext returns the identity verified by this issuer, if any.
+func (c *Config) FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(ctxKey(c.Scheme)).(*Identity)
+	return id, ok
+}
+
+// Show reports the user's email address, or their subject if the issuer did
+// not provide an address.
+func (c *Config) Show(ctx context.Context) (string, bool) {
+	id, ok := c.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	if id.Email != "" {
+		return id.Email, true
+	}
+	return id.Subject, true
+}
+
+func (c *Config) verify(ok okay.OK, match func(*Identity) bool) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		id, ok := c.FromContext(ctx)
+		if !ok {
+			return false, nil
+		}
+		return match(id), nil
+	})
+}
+
+// VerifyEmail returns an OK that verifies users with any of the given
+// verified email addresses.
+func (c *Config) VerifyEmail(ok okay.OK, emails ...string) okay.OK {
+	allowed := make(map[string]bool)
+	for _, e := range emails {
+		allowed[e] = true
+	}
+	return c.verify(ok, func(id *Identity) bool {
+		return id.EmailVerified && allowed[id.Email]
+	})
+}
+
+// VerifySubject returns an OK that verifies users with any of the given
+// subject identifiers.
+func (c *Config) VerifySubject(ok okay.OK, subs ...string) okay.OK {
+	allowed := make(map[string]bool)
+	for _, s := range subs {
+		allowed[s] = true
+	}
+	return c.verify(ok, func(id *Identity) bool {
+		return allowed[id.Subject]
+	})
+}
+
+// VerifyGroup returns an OK that verifies users in any of the given groups.
+func (c *Config) VerifyGroup(ok okay.OK, groups ...string) okay.OK {
+	allowed := make(map[string]bool)
+	for _, g := range groups {
+		allowed[g] = true
+	}
+	return c.verify(ok, func(id *Identity) bool {
+		for _, g := range id.Groups {
+			if allowed[g] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// VerifyClaim returns an OK that verifies users whose ID token has the named
+// claim set to any of the given values.  If the claim is a list, any element
+// may match.  Non-string claims are compared by their JSON encoding.
+func (c *Config) VerifyClaim(ok okay.OK, claim string, values ...string) okay.OK {
+	allowed := make(map[string]bool)
+	for _, v := range values {
+		allowed[v] = true
+	}
+	return c.verify(ok, func(id *Identity) bool {
+		v, ok := id.Claims[claim]
+		if !ok {
+			return false
+		}
+		vs, ok := v.([]interface{})
+		if !ok {
+			vs = []interface{}{v}
+		}
+		for _, v := range vs {
+			if allowed[claimString(v)] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func claimString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Verify returns an OK that verifies users matching any of the given
+// principals.  A principal may be
+//
+//	sub/<subject>
+//	group/<group>
+//	claim/<name>=<value>
+//
+// and anything else is taken to be an email address.  Malformed claim
+// principals, which CheckPrincipal rejects, match no one.
+func (c *Config) Verify(ok okay.OK, principals ...string) okay.OK {
+	for _, p := range principals {
+		switch {
+		case strings.HasPrefix(p, "sub/"):
+			ok = c.VerifySubject(ok, strings.TrimPrefix(p, "sub/"))
+		case strings.HasPrefix(p, "group/"):
+			ok = c.VerifyGroup(ok, strings.TrimPrefix(p, "group/"))
+		case strings.HasPrefix(p, "claim/"):
+			name, val, err := parseClaim(p)
+			if err != nil {
+				continue
+			}
+			ok = c.VerifyClaim(ok, name, val)
+		default:
+			ok = c.VerifyEmail(ok, p)
+		}
+	}
+	return ok
+}
+
+// CheckPrincipal reports an error if p is a malformed claim principal.
+func (c *Config) CheckPrincipal(p string) error {
+	if !strings.HasPrefix(p, "claim/") {
+		return nil
+	}
+	_, _, err := parseClaim(p)
+	return err
+}
+
+// parseClaim splits a principal of the form claim/<name>=<value>.
+func parseClaim(p string) (name, val string, err error) {
+	kv := strings.SplitN(strings.TrimPrefix(p, "claim/"), "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", fmt.Errorf("oidc: %q: claim principals must be of the form claim/name=value", p)
+	}
+	return kv[0], kv[1], nil
+}
@@ -0,0 +1,367 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+	"github.com/kurin/visage/provider"
+)
+
+// issuer is a minimal OpenID Connect issuer.  Every code is exchanged for an
+// ID token carrying the current claims.
+type issuer struct {
+	srv  *httptest.Server
+	key  *rsa.PrivateKey
+	sign *rsa.PrivateKey
+
+	mu      sync.Mutex
+	claims  map[string]interface{}
+	expires int // seconds until the access token expires
+	tokens  int // the number of tokens issued
+
+	// noRefreshID leaves the ID token out of refresh responses, as OpenID
+	// Connect allows.
+	noRefreshID bool
+}
+
+func newIssuer(t *testing.T) *issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &issuer{key: key, sign: key, expires: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                is.srv.URL,
+			"authorization_endpoint":                is.srv.URL + "/auth",
+			"token_endpoint":                        is.srv.URL + "/token",
+			"jwks_uri":                              is.srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   b64(is.key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(is.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		is.mu.Lock()
+		is.tokens++
+		expires := is.expires
+		noID := is.noRefreshID && r.FormValue("grant_type") == "refresh_token"
+		is.mu.Unlock()
+		resp := map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": "refresh",
+			"token_type":    "Bearer",
+			"expires_in":    expires,
+		}
+		if !noID {
+			resp["id_token"] = is.idToken(t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+	is.srv = httptest.NewServer(mux)
+	return is
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (is *issuer) idToken(t *testing.T) string {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	body, _ := json.Marshal(is.claims)
+	payload := b64(hdr) + "." + b64(body)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, is.sign, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload + "." + b64(sig)
+}
+
+// login runs the sign-in flow against mux, calling edit with the nonce the
+// client sent so that it can set the claims the issuer will return.  It
+// returns the response from the return handler.
+func login(t *testing.T, mux *http.ServeMux, is *issuer, edit func(nonce string) map[string]interface{}) *http.Response {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login: got %d, want redirect", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loc.Query().Get("state")
+
+	is.mu.Lock()
+	is.claims = edit(loc.Query().Get("nonce"))
+	is.mu.Unlock()
+
+	r := httptest.NewRequest("GET", "/return?"+url.Values{"state": {state}, "code": {"code"}}.Encode(), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestLogin(t *testing.T) {
+	is := newIssuer(t)
+	defer is.srv.Close()
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		Scheme:      "test",
+		Issuer:      is.srv.URL,
+		ClientID:    "client",
+		RedirectURI: "http://visage.example.com/return",
+		LogoutPath:  "/logout",
+	}
+	mux := http.NewServeMux()
+	if err := cfg.RegisterHandlers(mux, "/login", "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	good := func(nonce string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            is.srv.URL,
+			"aud":            "client",
+			"sub":            "1234",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"groups":         []string{"staff", "infra"},
+			"dept":           "ops",
+			"nonce":          nonce,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	table := []struct {
+		desc string
+		edit func(map[string]interface{})
+		sign *rsa.PrivateKey
+		ok   bool
+	}{
+		{
+			desc: "valid",
+			ok:   true,
+		},
+		{
+			desc: "wrong audience",
+			edit: func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		},
+		{
+			desc: "wrong issuer",
+			edit: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		},
+		{
+			desc: "wrong nonce",
+			edit: func(c map[string]interface{}) { c["nonce"] = "replayed" },
+		},
+		{
+			desc: "expired",
+			edit: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		},
+		{
+			desc: "bad signature",
+			sign: other,
+		},
+	}
+
+	for _, ent := range table {
+		is.sign = is.key
+		if ent.sign != nil {
+			is.sign = ent.sign
+		}
+		resp := login(t, mux, is, func(nonce string) map[string]interface{} {
+			c := good(nonce)
+			if ent.edit != nil {
+				ent.edit(c)
+			}
+			return c
+		})
+		if !ent.ok {
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s: got %d, want %d", ent.desc, resp.StatusCode, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("%s: got %d, want %d", ent.desc, resp.StatusCode, http.StatusTemporaryRedirect)
+			continue
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, c := range resp.Cookies() {
+			r.AddCookie(c)
+		}
+		ctx := cfg.Context(context.Background(), r)
+		if got, _ := cfg.Show(ctx); got != "user@example.com" {
+			t.Errorf("%s: Show: got %q, want %q", ent.desc, got, "user@example.com")
+		}
+
+		oks := []struct {
+			principal string
+			want      bool
+		}{
+			{"user@example.com", true},
+			{"other@example.com", false},
+			{"sub/1234", true},
+			{"sub/5678", false},
+			{"group/infra", true},
+			{"group/finance", false},
+			{"claim/dept=ops", true},
+			{"claim/dept=sales", false},
+		}
+		for _, o := range oks {
+			if got, _ := cfg.Verify(okay.New(), o.principal).Verify(ctx); got != o.want {
+				t.Errorf("%s: Verify(%q): got %v, want %v", ent.desc, o.principal, got, o.want)
+			}
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	is := newIssuer(t)
+	defer is.srv.Close()
+	// Access tokens this short-lived are refreshed on every use.
+	is.expires = 1
+
+	cfg := &Config{
+		Scheme:      "test",
+		Issuer:      is.srv.URL,
+		ClientID:    "client",
+		RedirectURI: "http://visage.example.com/return",
+		LogoutPath:  "/logout",
+	}
+	mux := http.NewServeMux()
+	if err := cfg.RegisterHandlers(mux, "/login", "/"); err != nil {
+		t.Fatal(err)
+	}
+	claims := func(email string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":            is.srv.URL,
+			"aud":            "client",
+			"sub":            "1234",
+			"email":          email,
+			"email_verified": true,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	resp := login(t, mux, is, func(nonce string) map[string]interface{} {
+		c := claims("old@example.com")
+		c["nonce"] = nonce
+		return c
+	})
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("login: got %d, want %d", resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+
+	// The refreshed ID token carries new claims, and no nonce.
+	is.mu.Lock()
+	is.claims = claims("new@example.com")
+	is.mu.Unlock()
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range resp.Cookies() {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	ctx := cfg.Context(provider.WithResponseWriter(context.Background(), w), r)
+	if got, _ := cfg.Show(ctx); got != "new@example.com" {
+		t.Errorf("Show after refresh: got %q, want %q", got, "new@example.com")
+	}
+	is.mu.Lock()
+	tokens := is.tokens
+	is.mu.Unlock()
+	if tokens != 2 {
+		t.Errorf("got %d tokens issued, want 2", tokens)
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Errorf("refresh: got %d cookies, want the refreshed session", len(w.Result().Cookies()))
+	}
+
+	// Without an ID token, a refresh keeps the claims it had.
+	is.mu.Lock()
+	is.noRefreshID = true
+	is.claims = claims("newer@example.com")
+	is.mu.Unlock()
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	ctx = cfg.Context(context.Background(), r)
+	if got, ok := cfg.Show(ctx); !ok || got != "new@example.com" {
+		t.Errorf("Show after refresh without an ID token: got (%q, %v), want (%q, true)", got, ok, "new@example.com")
+	}
+	is.mu.Lock()
+	tokens = is.tokens
+	is.mu.Unlock()
+	if tokens != 3 {
+		t.Errorf("got %d tokens issued, want 3", tokens)
+	}
+}
+
+func TestCheckPrincipal(t *testing.T) {
+	table := []struct {
+		p  string
+		ok bool
+	}{
+		{p: "user@example.com", ok: true},
+		{p: "sub/1234", ok: true},
+		{p: "claim/dept=ops", ok: true},
+		{p: "claim/dept=", ok: true},
+		{p: "claim/dept"},
+		{p: "claim/=ops"},
+	}
+	c := &Config{Scheme: "test"}
+	for _, ent := range table {
+		if err := c.CheckPrincipal(ent.p); (err == nil) != ent.ok {
+			t.Errorf("CheckPrincipal(%q): got %v, want ok %v", ent.p, err, ent.ok)
+		}
+	}
+}
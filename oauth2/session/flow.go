@@ -0,0 +1,186 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// stateTTL bounds how long a user may take to sign in.
+const stateTTL = 10 * time.Minute
+
+// A Flow is a provider's OAuth2 sign-in: users are sent to the provider,
+// and when they return with a code, it is exchanged for a token and a
+// session started with the token's identity.  Providers supply the OAuth2
+// configuration and the Resolver; the rest is common to them all.
+type Flow struct {
+	// Config is the provider's OAuth2 configuration.  Users return to its
+	// RedirectURL.
+	Config *oauth2.Config
+
+	// Resolve fetches the identity of a signed-in user.
+	Resolve Resolver
+
+	// SessionCookie and StateCookie name the cookies that hold the session
+	// and a sign-in in progress.
+	SessionCookie string
+	StateCookie   string
+
+	// Options are passed to AuthCodeURL.
+	Options []oauth2.AuthCodeOption
+
+	// Nonce, if set, sends a random nonce with each sign-in.  Resolvers
+	// can read it at sign-in with Nonce.
+	Nonce bool
+
+	// Client, if set, is used to exchange codes for tokens.
+	Client *http.Client
+
+	// TTL is how long a sign-in lasts.  If zero, DefaultTTL is used.
+	TTL time.Duration
+
+	// Keys sign and encrypt cookies.  The first pair is used for new
+	// cookies, and the rest are still accepted, so that keys can be
+	// rotated.  If empty, random keys are used and sign-ins do not survive
+	// a restart.
+	Keys []KeyPair
+}
+
+type loginState struct {
+	State string
+	Nonce string
+}
+
+type nonceKey struct{}
+
+// Nonce returns the nonce sent with the sign-in whose identity a Resolver is
+// asked for, if the Flow sent one.
+func Nonce(ctx context.Context) (string, bool) {
+	n, ok := ctx.Value(nonceKey{}).(string)
+	return n, ok
+}
+
+// Register registers the flow's handlers on mux: the landing URL that begins
+// a sign-in at path, the return handler at the path of the RedirectURL, and
+// the sign-out handler at logout.  Users are sent to home after signing in or
+// out.  It returns the Manager that keeps the flow's sessions.
+func (f *Flow) Register(mux *http.ServeMux, path, logout, home string) (*Manager, error) {
+	r, err := url.Parse(f.Config.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := NewCodec(f.Keys...)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		Cookie:  f.SessionCookie,
+		Codec:   codec,
+		Config:  f.Config,
+		Resolve: f.Resolve,
+		TTL:     f.TTL,
+		Cookies: Cookies{Secure: r.Scheme == "https"},
+	}
+	mux.HandleFunc(path, f.loginHandler(m))
+	mux.HandleFunc(r.Path, f.loginReturnHandler(m, home))
+	mux.HandleFunc(logout, func(w http.ResponseWriter, r *http.Request) {
+		m.End(w, r)
+		http.Redirect(w, r, home, http.StatusTemporaryRedirect)
+	})
+	return m, nil
+}
+
+func random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(b)), nil
+}
+
+func (f *Flow) loginHandler(m *Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ls loginState
+		var err error
+		if ls.State, err = random(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		opts := f.Options
+		if f.Nonce {
+			if ls.Nonce, err = random(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			opts = append(opts[:len(opts):len(opts)], oauth2.SetAuthURLParam("nonce", ls.Nonce))
+		}
+		code, err := m.Codec.Encode(f.StateCookie, ls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.Cookies.Set(w, f.StateCookie, code, time.Now().Add(stateTTL))
+		http.Redirect(w, r, f.Config.AuthCodeURL(ls.State, opts...), http.StatusTemporaryRedirect)
+	}
+}
+
+func (f *Flow) loginReturnHandler(m *Manager, home string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(f.StateCookie)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ls loginState
+		if err := m.Codec.Decode(f.StateCookie, c.Value, &ls); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("state") != ls.State {
+			http.Error(w, "oauth2 state mismatch", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		if f.Client != nil {
+			ctx = context.WithValue(ctx, oauth2.HTTPClient, f.Client)
+		}
+		token, err := f.Config.Exchange(ctx, r.FormValue("code"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if f.Nonce {
+			ctx = context.WithValue(ctx, nonceKey{}, ls.Nonce)
+		}
+		if err := m.Start(ctx, w, token); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		m.Cookies.Clear(w, f.StateCookie)
+		rURI := r.FormValue("redirect_uri")
+		if rURI == "" {
+			rURI = home
+		}
+		http.Redirect(w, r, rURI, http.StatusTemporaryRedirect)
+	}
+}
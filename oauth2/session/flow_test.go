@@ -0,0 +1,142 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestFlow(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+		})
+	}))
+	defer srv.Close()
+
+	var nonce string
+	f := &Flow{
+		Config: &oauth2.Config{
+			ClientID:    "client",
+			Endpoint:    oauth2.Endpoint{AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"},
+			RedirectURL: "https://visage.example.com/return",
+		},
+		Resolve: func(ctx context.Context, _ *http.Client) ([]byte, error) {
+			nonce, _ = Nonce(ctx)
+			return []byte("user"), nil
+		},
+		SessionCookie: "test-session",
+		StateCookie:   "test-state",
+		Nonce:         true,
+	}
+	mux := http.NewServeMux()
+	m, err := f.Register(mux, "/login", "/logout", "/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login begins a sign-in, and returns the state and nonce sent to the
+	// provider along with the cookies to return with.
+	login := func() (url.Values, []*http.Cookie) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("login: got %d, want redirect", w.Code)
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.Query(), w.Result().Cookies()
+	}
+
+	table := []struct {
+		desc  string
+		state string
+		code  int
+	}{
+		{desc: "state mismatch", state: "forged", code: http.StatusBadRequest},
+		{desc: "valid", code: http.StatusTemporaryRedirect},
+	}
+	for _, ent := range table {
+		q, cs := login()
+		if q.Get("nonce") == "" {
+			t.Errorf("%s: no nonce sent", ent.desc)
+		}
+		state := q.Get("state")
+		if ent.state != "" {
+			state = ent.state
+		}
+		r := httptest.NewRequest("GET", "/return?"+url.Values{"state": {state}, "code": {"code"}}.Encode(), nil)
+		for _, c := range cs {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != ent.code {
+			t.Errorf("%s: return: got %d, want %d", ent.desc, w.Code, ent.code)
+			continue
+		}
+		if w.Code != http.StatusTemporaryRedirect {
+			continue
+		}
+		if loc := w.Header().Get("Location"); loc != "/home" {
+			t.Errorf("%s: return: sent to %q, want /home", ent.desc, loc)
+		}
+		if nonce != q.Get("nonce") {
+			t.Errorf("%s: Resolver saw nonce %q, want %q", ent.desc, nonce, q.Get("nonce"))
+		}
+		r = httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == f.SessionCookie {
+				if !c.Secure {
+					t.Errorf("%s: session cookie is not Secure", ent.desc)
+				}
+				r.AddCookie(c)
+			}
+		}
+		if id, ok := m.Get(context.Background(), r); !ok || string(id) != "user" {
+			t.Errorf("%s: Get: got (%q, %v), want (user, true)", ent.desc, id, ok)
+		}
+
+		w = httptest.NewRecorder()
+		lr := httptest.NewRequest("GET", "/logout", nil)
+		for _, c := range r.Cookies() {
+			lr.AddCookie(c)
+		}
+		mux.ServeHTTP(w, lr)
+		if loc := w.Header().Get("Location"); loc != "/home" {
+			t.Errorf("%s: logout: sent to %q, want /home", ent.desc, loc)
+		}
+		var cleared bool
+		for _, c := range w.Result().Cookies() {
+			if c.Name == f.SessionCookie && c.MaxAge < 0 {
+				cleared = true
+			}
+		}
+		if !cleared {
+			t.Errorf("%s: logout: session cookie not cleared", ent.desc)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package session
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+// A KeyPair holds the keys for signing and encrypting cookies.  Hash should
+// be 32 or 64 bytes long.  Block must be 16, 24, or 32 bytes long; it is
+// required because session cookies carry the user's OAuth2 tokens.
+type KeyPair struct {
+	Hash  []byte
+	Block []byte
+}
+
+// NewCodec returns a codec that encodes cookies with the first key pair, and
+// decodes cookies made with any of them.  Keys are rotated by adding a new
+// pair to the front of the list and keeping the old ones until their
+// cookies have expired.  If no keys are given, random ones are used, and
+// cookies will not survive a restart.
+func NewCodec(keys ...KeyPair) (securecookie.Codec, error) {
+	if len(keys) == 0 {
+		keys = []KeyPair{{
+			Hash:  securecookie.GenerateRandomKey(64),
+			Block: securecookie.GenerateRandomKey(32),
+		}}
+		if keys[0].Hash == nil || keys[0].Block == nil {
+			return nil, errors.New("session: couldn't generate random key")
+		}
+	}
+	var cs codecs
+	for i, k := range keys {
+		if len(k.Hash) == 0 {
+			return nil, fmt.Errorf("session: key %d: no hash key", i)
+		}
+		switch len(k.Block) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("session: key %d: block key must be 16, 24, or 32 bytes", i)
+		}
+		sc := securecookie.New(k.Hash, k.Block)
+		// Sessions carry their own expiry.
+		sc.MaxAge(0)
+		cs = append(cs, sc)
+	}
+	return cs, nil
+}
+
+type codecs []securecookie.Codec
+
+func (cs codecs) Encode(name string, value interface{}) (string, error) {
+	return cs[0].Encode(name, value)
+}
+
+func (cs codecs) Decode(name, value string, dst interface{}) error {
+	return securecookie.DecodeMulti(name, value, dst, cs...)
+}
+
+// ReadKeyFile reads key pairs from the named file.  Each line holds a hash
+// key and a block key, base64 encoded and separated by whitespace.  Blank
+// lines and lines beginning with # are ignored.  The first pair is the
+// current one; the rest are accepted only for decoding.
+func ReadKeyFile(path string) ([]KeyPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []KeyPair
+	s := bufio.NewScanner(f)
+	var n int
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("session: %s:%d: want a hash key and a block key", path, n)
+		}
+		var k KeyPair
+		if k.Hash, err = base64.StdEncoding.DecodeString(fields[0]); err != nil {
+			return nil, fmt.Errorf("session: %s:%d: %v", path, n, err)
+		}
+		if k.Block, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return nil, fmt.Errorf("session: %s:%d: %v", path, n, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("session: %s: no keys", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,190 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestRotation(t *testing.T) {
+	old := KeyPair{Hash: bytes.Repeat([]byte{1}, 32), Block: bytes.Repeat([]byte{2}, 16)}
+	cur := KeyPair{Hash: bytes.Repeat([]byte{3}, 32), Block: bytes.Repeat([]byte{4}, 16)}
+	stranger := KeyPair{Hash: bytes.Repeat([]byte{5}, 32), Block: bytes.Repeat([]byte{6}, 16)}
+
+	before, err := NewCodec(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := NewCodec(cur, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCodec(stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCookie, err := before.Encode("c", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCookie, err := after.Encode("c", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		desc   string
+		codec  securecookie.Codec
+		cookie string
+		ok     bool
+	}{
+		{
+			desc:   "old cookie after rotation",
+			codec:  after,
+			cookie: oldCookie,
+			ok:     true,
+		},
+		{
+			desc:   "new cookie after rotation",
+			codec:  after,
+			cookie: newCookie,
+			ok:     true,
+		},
+		{
+			desc:   "new cookie before rotation",
+			codec:  before,
+			cookie: newCookie,
+		},
+		{
+			desc:   "unknown key",
+			codec:  other,
+			cookie: newCookie,
+		},
+	}
+
+	for _, ent := range table {
+		var got string
+		err := ent.codec.Decode("c", ent.cookie, &got)
+		if (err == nil) != ent.ok {
+			t.Errorf("%s: got err %v, want ok %v", ent.desc, err, ent.ok)
+			continue
+		}
+		if ent.ok && got != "hello" {
+			t.Errorf("%s: got %q, want %q", ent.desc, got, "hello")
+		}
+	}
+}
+
+func TestNewCodecBadKeys(t *testing.T) {
+	table := []KeyPair{
+		{},
+		{Hash: []byte("hash")},
+		{Hash: []byte("hash"), Block: []byte("short")},
+	}
+	for _, ent := range table {
+		if _, err := NewCodec(ent); err == nil {
+			t.Errorf("NewCodec(%v): got no error", ent)
+		}
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "visage-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h1, b1 := bytes.Repeat([]byte{1}, 64), bytes.Repeat([]byte{2}, 32)
+	h2, b2 := bytes.Repeat([]byte{3}, 32), bytes.Repeat([]byte{4}, 16)
+	enc := base64.StdEncoding.EncodeToString
+	table := []struct {
+		desc string
+		data string
+		want []KeyPair
+	}{
+		{
+			desc: "rotated keys",
+			data: "# current\n" + enc(h1) + " " + enc(b1) + "\n\n# old\n" + enc(h2) + " " + enc(b2) + "\n",
+			want: []KeyPair{{Hash: h1, Block: b1}, {Hash: h2, Block: b2}},
+		},
+		{
+			desc: "no block key",
+			data: enc(h1) + "\n",
+		},
+		{
+			desc: "empty",
+			data: "# nothing here\n",
+		},
+		{
+			desc: "bad encoding",
+			data: "not*base64\n",
+		},
+		{
+			desc: "too many fields",
+			data: enc(h1) + " " + enc(b1) + " " + enc(b1) + "\n",
+		},
+	}
+
+	for i, ent := range table {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(ent.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadKeyFile(path)
+		if ent.want == nil {
+			if err == nil {
+				t.Errorf("%s: got no error", ent.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", ent.desc, err)
+			continue
+		}
+		if len(got) != len(ent.want) {
+			t.Errorf("%s: got %d keys, want %d", ent.desc, len(got), len(ent.want))
+			continue
+		}
+		for j := range got {
+			if !bytes.Equal(got[j].Hash, ent.want[j].Hash) || !bytes.Equal(got[j].Block, ent.want[j].Block) {
+				t.Errorf("%s: key %d: got %v, want %v", ent.desc, j, got[j], ent.want[j])
+			}
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	w := httptest.NewRecorder()
+	Cookies{Secure: true}.Set(w, "c", "v", time.Now().Add(time.Hour))
+	cs := w.Result().Cookies()
+	if len(cs) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cs))
+	}
+	c := cs[0]
+	if c.Path != "/" || !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got cookie %v, want Path=/ Secure HttpOnly SameSite=Lax", c)
+	}
+}
@@ -0,0 +1,272 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package session keeps the identity resolved at sign-in in a signed cookie,
+// so that providers need not consult the identity service on every request.
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kurin/visage/provider"
+	"golang.org/x/oauth2"
+)
+
+// DefaultTTL is how long a session lasts if the Manager does not say.
+const DefaultTTL = 24 * time.Hour
+
+// maxCache bounds the number of decoded sessions held in memory.
+const maxCache = 4096
+
+// A Resolver fetches the identity of the user whose token authorizes client.
+// The identity is opaque to the Manager.  The token itself is available from
+// ctx with Token.
+type Resolver func(ctx context.Context, client *http.Client) ([]byte, error)
+
+type tokenKey struct{}
+
+// Token returns the token whose identity a Resolver is asked for.  It is
+// meant to be called from a Resolver that needs more than an authorized
+// client, such as one that reads an ID token from the token response.
+func Token(ctx context.Context) (*oauth2.Token, bool) {
+	tok, ok := ctx.Value(tokenKey{}).(*oauth2.Token)
+	return tok, ok
+}
+
+type refreshingKey struct{}
+
+// Refreshing returns the identity of the session being refreshed, when a
+// Resolver is asked for the identity of a refreshed token.  It is meant for
+// Resolvers that may not get everything they need on a refresh, and would
+// rather keep what they had.
+func Refreshing(ctx context.Context) ([]byte, bool) {
+	id, ok := ctx.Value(refreshingKey{}).([]byte)
+	return id, ok
+}
+
+func (m *Manager) resolve(ctx context.Context, tok *oauth2.Token) ([]byte, error) {
+	ctx = context.WithValue(ctx, tokenKey{}, tok)
+	return m.Resolve(ctx, m.Config.Client(ctx, tok))
+}
+
+// Session is the state kept in the session cookie.
+type Session struct {
+	// Identity is the value returned by the Resolver.
+	Identity []byte
+
+	// Token is the user's OAuth2 token.  When its access token expires, it is
+	// refreshed and the identity resolved again.  A token without a refresh
+	// token cannot be refreshed, so its identity is kept until the session
+	// expires.
+	Token *oauth2.Token
+
+	// Expires is the time after which the session is no longer accepted.
+	Expires time.Time
+}
+
+// A Manager starts, reads, and ends sessions for one provider.
+type Manager struct {
+	// Cookie is the name of the session cookie.
+	Cookie string
+
+	// Codec signs and encrypts the session cookie.
+	Codec securecookie.Codec
+
+	// Config is used to refresh expired access tokens.
+	Config *oauth2.Config
+
+	// Resolve fetches the user's identity.
+	Resolve Resolver
+
+	// TTL is how long a session lasts.  If zero, DefaultTTL is used.
+	TTL time.Duration
+
+	// Cookies sets the attributes of the session cookie.
+	Cookies Cookies
+
+	mu    sync.Mutex
+	cache map[string]*Session
+}
+
+var errExpired = errors.New("session: expired")
+
+func (m *Manager) ttl() time.Duration {
+	if m.TTL == 0 {
+		return DefaultTTL
+	}
+	return m.TTL
+}
+
+// Start resolves the identity of the user who holds tok, and sets a cookie
+// carrying a new session.
+func (m *Manager) Start(ctx context.Context, w http.ResponseWriter, tok *oauth2.Token) error {
+	id, err := m.resolve(ctx, tok)
+	if err != nil {
+		return err
+	}
+	s := &Session{
+		Identity: id,
+		Token:    tok,
+		Expires:  time.Now().Add(m.ttl()),
+	}
+	enc, err := m.Codec.Encode(m.Cookie, s)
+	if err != nil {
+		return err
+	}
+	m.put(enc, s)
+	m.Cookies.Set(w, m.Cookie, enc, s.Expires)
+	return nil
+}
+
+// Get returns the identity from the request's session, if it has one.  Get
+// does not make network calls unless the session's access token has expired
+// and can be refreshed, in which case it is refreshed and the identity
+// resolved again.  The refreshed session is sent back in a new cookie if ctx
+// carries the response writer (see provider.WithResponseWriter), so that
+// other servers need not refresh it too.
+func (m *Manager) Get(ctx context.Context, r *http.Request) ([]byte, bool) {
+	c, err := r.Cookie(m.Cookie)
+	if err != nil {
+		return nil, false
+	}
+	s, err := m.session(c.Value)
+	if err != nil {
+		return nil, false
+	}
+	if s.Token == nil || s.Token.Valid() || s.Token.Expiry.IsZero() || s.Token.RefreshToken == "" {
+		return s.Identity, true
+	}
+	s, err = m.refresh(ctx, c.Value, s)
+	if err != nil {
+		return nil, false
+	}
+	return s.Identity, true
+}
+
+// End removes the request's session.
+func (m *Manager) End(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(m.Cookie); err == nil {
+		m.mu.Lock()
+		delete(m.cache, c.Value)
+		m.mu.Unlock()
+	}
+	m.Cookies.Clear(w, m.Cookie)
+}
+
+// session returns the decoded session for the given cookie value.
+func (m *Manager) session(value string) (*Session, error) {
+	m.mu.Lock()
+	s, ok := m.cache[value]
+	m.mu.Unlock()
+	if !ok {
+		s = &Session{}
+		if err := m.Codec.Decode(m.Cookie, value, s); err != nil {
+			return nil, err
+		}
+	}
+	if !time.Now().Before(s.Expires) {
+		m.mu.Lock()
+		delete(m.cache, value)
+		m.mu.Unlock()
+		return nil, errExpired
+	}
+	if !ok {
+		m.put(value, s)
+	}
+	return s, nil
+}
+
+// refresh obtains a new access token for s and resolves the identity again.
+// The refreshed session is also cached under the original cookie value, for
+// requests that still carry it.
+func (m *Manager) refresh(ctx context.Context, value string, s *Session) (*Session, error) {
+	tok, err := m.Config.TokenSource(ctx, s.Token).Token()
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.resolve(context.WithValue(ctx, refreshingKey{}, s.Identity), tok)
+	if err != nil {
+		return nil, err
+	}
+	n := &Session{
+		Identity: id,
+		Token:    tok,
+		Expires:  s.Expires,
+	}
+	enc, err := m.Codec.Encode(m.Cookie, n)
+	if err != nil {
+		return nil, err
+	}
+	m.put(value, n)
+	m.put(enc, n)
+	if w, ok := provider.ResponseWriter(ctx); ok {
+		m.Cookies.Set(w, m.Cookie, enc, n.Expires)
+	}
+	return n, nil
+}
+
+func (m *Manager) put(value string, s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cache == nil || len(m.cache) >= maxCache {
+		m.cache = make(map[string]*Session)
+	}
+	m.cache[value] = s
+}
+
+// Cookies sets cookies with consistent attributes.  Cookies are always
+// HttpOnly, and SameSite=Lax so that they are sent on the redirect back from
+// the identity provider.
+type Cookies struct {
+	// Path scopes the cookies.  It defaults to "/".
+	Path string
+
+	// Secure restricts the cookies to HTTPS.
+	Secure bool
+}
+
+func (c Cookies) cookie(name string) *http.Cookie {
+	p := c.Path
+	if p == "" {
+		p = "/"
+	}
+	return &http.Cookie{
+		Name:     name,
+		Path:     p,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Set sets the named cookie.  If expires is zero, the cookie lasts until the
+// browser is closed.
+func (c Cookies) Set(w http.ResponseWriter, name, value string, expires time.Time) {
+	ck := c.cookie(name)
+	ck.Value = value
+	ck.Expires = expires
+	http.SetCookie(w, ck)
+}
+
+// Clear removes the named cookie.
+func (c Cookies) Clear(w http.ResponseWriter, name string) {
+	ck := c.cookie(name)
+	ck.MaxAge = -1
+	http.SetCookie(w, ck)
+}
@@ -0,0 +1,233 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kurin/visage/provider"
+	"golang.org/x/oauth2"
+)
+
+type counter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *counter) inc() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n
+}
+
+func (c *counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func newManager(t *testing.T, ttl time.Duration) (*Manager, *counter, *counter, func()) {
+	refreshes, resolves := &counter{}, &counter{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := refreshes.inc()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  fmt.Sprintf("access-%d", n),
+			"refresh_token": "refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	m := &Manager{
+		Cookie: "test-session",
+		Codec:  securecookie.New(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)),
+		Config: &oauth2.Config{
+			ClientID: "client",
+			Endpoint: oauth2.Endpoint{TokenURL: srv.URL},
+		},
+		Resolve: func(ctx context.Context, client *http.Client) ([]byte, error) {
+			return []byte(fmt.Sprintf("user-%d", resolves.inc())), nil
+		},
+		TTL: ttl,
+	}
+	return m, refreshes, resolves, srv.Close
+}
+
+func start(t *testing.T, m *Manager, tok *oauth2.Token) *http.Request {
+	w := httptest.NewRecorder()
+	if err := m.Start(context.Background(), w, tok); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestGet(t *testing.T) {
+	table := []struct {
+		desc      string
+		expiry    time.Time
+		ttl       time.Duration
+		forget    bool
+		norefresh bool
+		want      string
+		ok        bool
+		refreshes int
+		resolves  int
+	}{
+		{
+			desc:     "valid token",
+			expiry:   time.Now().Add(time.Hour),
+			want:     "user-1",
+			ok:       true,
+			resolves: 1,
+		},
+		{
+			desc:     "token without expiry",
+			want:     "user-1",
+			ok:       true,
+			resolves: 1,
+		},
+		{
+			desc:     "decoded from cookie",
+			expiry:   time.Now().Add(time.Hour),
+			forget:   true,
+			want:     "user-1",
+			ok:       true,
+			resolves: 1,
+		},
+		{
+			desc:      "expired token",
+			expiry:    time.Now().Add(-time.Minute),
+			want:      "user-2",
+			ok:        true,
+			refreshes: 1,
+			resolves:  2,
+		},
+		{
+			desc:      "expired token without refresh token",
+			expiry:    time.Now().Add(-time.Minute),
+			norefresh: true,
+			want:      "user-1",
+			ok:        true,
+			resolves:  1,
+		},
+		{
+			desc:      "expired token without refresh token, decoded from cookie",
+			expiry:    time.Now().Add(-time.Minute),
+			forget:    true,
+			norefresh: true,
+			want:      "user-1",
+			ok:        true,
+			resolves:  1,
+		},
+		{
+			desc:     "expired session",
+			expiry:   time.Now().Add(time.Hour),
+			ttl:      -time.Minute,
+			resolves: 1,
+		},
+	}
+
+	for _, ent := range table {
+		m, refreshes, resolves, done := newManager(t, ent.ttl)
+		tok := &oauth2.Token{
+			AccessToken:  "access-0",
+			RefreshToken: "refresh",
+			Expiry:       ent.expiry,
+		}
+		if ent.norefresh {
+			tok.RefreshToken = ""
+		}
+		r := start(t, m, tok)
+		if ent.forget {
+			m.cache = nil
+		}
+		for i := 0; i < 5; i++ {
+			got, ok := m.Get(context.Background(), r)
+			if ok != ent.ok || string(got) != ent.want {
+				t.Errorf("%s: Get: got (%q, %v), want (%q, %v)", ent.desc, got, ok, ent.want, ent.ok)
+			}
+		}
+		if got := refreshes.get(); got != ent.refreshes {
+			t.Errorf("%s: got %d refreshes, want %d", ent.desc, got, ent.refreshes)
+		}
+		if got := resolves.get(); got != ent.resolves {
+			t.Errorf("%s: got %d resolves, want %d", ent.desc, got, ent.resolves)
+		}
+		done()
+	}
+}
+
+func TestEnd(t *testing.T) {
+	m, _, _, done := newManager(t, 0)
+	defer done()
+	r := start(t, m, &oauth2.Token{AccessToken: "access-0"})
+	w := httptest.NewRecorder()
+	m.End(w, r)
+	if len(m.cache) != 0 {
+		t.Errorf("End: session still cached")
+	}
+	var cleared bool
+	for _, c := range w.Result().Cookies() {
+		if c.Name == m.Cookie && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("End: cookie not cleared")
+	}
+}
+
+func TestRefreshSetsCookie(t *testing.T) {
+	m, refreshes, _, done := newManager(t, 0)
+	defer done()
+	r := start(t, m, &oauth2.Token{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(-time.Minute),
+	})
+	w := httptest.NewRecorder()
+	if _, ok := m.Get(provider.WithResponseWriter(context.Background(), w), r); !ok {
+		t.Fatal("Get: no session")
+	}
+	cs := w.Result().Cookies()
+	if len(cs) != 1 || cs[0].Name != m.Cookie {
+		t.Fatalf("Get: got cookies %v, want a new session cookie", cs)
+	}
+
+	// Another server, sharing only the keys, reads the new cookie without
+	// refreshing again.
+	other := &Manager{Cookie: m.Cookie, Codec: m.Codec, Config: m.Config, Resolve: m.Resolve}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cs[0])
+	if got, ok := other.Get(context.Background(), r); !ok || string(got) != "user-2" {
+		t.Errorf("Get with refreshed cookie: got (%q, %v), want (user-2, true)", got, ok)
+	}
+	if got := refreshes.get(); got != 1 {
+		t.Errorf("got %d refreshes, want 1", got)
+	}
+}
@@ -0,0 +1,266 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/okay"
+)
+
+// The helpers in this file restrict the paths an OK allows.  Each wraps the
+// given OK, so that a path must satisfy both the new restriction and any the
+// OK already has; to allow one of several paths, pass them all to a single
+// call.  Paths are cleaned the way file systems clean them before they are
+// compared, so "a/../b", "/b/" and "b" are all "/b".
+//
+// The helpers also answer Probes and Traversals, so that Views can show the
+// way to the paths they allow.
+
+// A Probe is passed to an OK's Allow functions in place of a path when a View
+// asks whether the caller could access the path without accessing it, such
+// as when deciding which entries of a directory to show.  Allow functions
+// that count accesses should not count Probes.  An OK that refuses a Probe is
+// asked again with the path itself, so that OKs written before Probes still
+// work; since an Allow function cannot tell that check from an access, OKs
+// that count uses should do so in a verifier, with Accessing.
+type Probe string
+
+// A Traversal is passed to an OK's Allow functions when a View needs to know
+// whether the caller may be granted anything beneath a directory.  An OK
+// that allows the Traversal makes the directory traversable: it can be
+// listed, showing only what the caller may see, even though the directory
+// itself is not granted.  Allow functions that do not recognize Traversals
+// should refuse them.
+type Traversal string
+
+// pathOK is an OK whose Allows also requires that the path match.
+type pathOK struct {
+	okay.OK
+	match func(string) bool
+
+	// reach reports whether match could hold for something beneath the
+	// given directory.
+	reach func(string) bool
+}
+
+func (p pathOK) Allows(i interface{}) (bool, error) {
+	switch r := i.(type) {
+	case string:
+		if !p.match(cleanPath(r)) {
+			return false, nil
+		}
+	case Probe:
+		if !p.match(cleanPath(string(r))) {
+			return false, nil
+		}
+	case Traversal:
+		if !p.reach(cleanPath(string(r))) {
+			return false, nil
+		}
+	default:
+		return false, nil
+	}
+	return p.OK.Allows(i)
+}
+
+// cleanPath returns p as an absolute, slash-separated path with any . and
+// .. elements resolved, just as absPath does before joining it to a root.
+func cleanPath(p string) string {
+	return filepath.ToSlash(filepath.Join("/", filepath.FromSlash(p)))
+}
+
+func under(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// segments splits a clean path into its elements.
+func segments(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+func always(string) bool { return true }
+
+// AllowPrefix returns an OK that allows only paths that begin with one of
+// the given prefixes.  The comparison is of strings, so "/logs" allows
+// "/logs2"; a prefix ending in a slash allows only what is beneath it.
+func AllowPrefix(ok okay.OK, prefixes ...string) okay.OK {
+	var pfxs []string
+	for _, pfx := range prefixes {
+		c := cleanPath(pfx)
+		if strings.HasSuffix(pfx, "/") && c != "/" {
+			c += "/"
+		}
+		pfxs = append(pfxs, c)
+	}
+	return pathOK{
+		OK: ok,
+		match: func(p string) bool {
+			for _, pfx := range pfxs {
+				if strings.HasPrefix(p, pfx) {
+					return true
+				}
+			}
+			return false
+		},
+		reach: func(dir string) bool {
+			if dir != "/" {
+				dir += "/"
+			}
+			for _, pfx := range pfxs {
+				if strings.HasPrefix(dir, pfx) || strings.HasPrefix(pfx, dir) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// AllowSubtree returns an OK that allows only the given directories and
+// everything beneath them.
+func AllowSubtree(ok okay.OK, dirs ...string) okay.OK {
+	return AllowPaths(ok, nil, dirs)
+}
+
+// AllowPaths returns an OK that allows only the given files, exactly, and
+// the given directories together with everything beneath them.  A file that
+// turns out to be a directory grants only the directory itself.
+func AllowPaths(ok okay.OK, files, dirs []string) okay.OK {
+	var fs, ds []string
+	for _, f := range files {
+		fs = append(fs, cleanPath(f))
+	}
+	for _, d := range dirs {
+		ds = append(ds, cleanPath(d))
+	}
+	return pathOK{
+		OK: ok,
+		match: func(p string) bool {
+			for _, f := range fs {
+				if p == f {
+					return true
+				}
+			}
+			for _, d := range ds {
+				if under(p, d) {
+					return true
+				}
+			}
+			return false
+		},
+		reach: func(dir string) bool {
+			for _, f := range fs {
+				if under(f, dir) {
+					return true
+				}
+			}
+			for _, d := range ds {
+				if under(dir, d) || under(d, dir) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// AllowGlob returns an OK that allows only paths matching one of the given
+// patterns, in the syntax of path.Match.  Patterns are matched against
+// cleaned, absolute paths, and so should begin with a slash.
+func AllowGlob(ok okay.OK, patterns ...string) (okay.OK, error) {
+	var pats []string
+	for _, pat := range patterns {
+		pat = cleanPath(pat)
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, err
+		}
+		pats = append(pats, pat)
+	}
+	return pathOK{
+		OK: ok,
+		match: func(p string) bool {
+			for _, pat := range pats {
+				if m, _ := path.Match(pat, p); m {
+					return true
+				}
+			}
+			return false
+		},
+		reach: func(dir string) bool {
+			// Wildcards never match a slash, so only a pattern with more
+			// elements than dir, whose leading elements match dir's, can
+			// match beneath it.
+			ds := segments(dir)
+		pats:
+			for _, pat := range pats {
+				ps := segments(pat)
+				if len(ps) <= len(ds) {
+					continue
+				}
+				for i, d := range ds {
+					if m, _ := path.Match(ps[i], d); !m {
+						continue pats
+					}
+				}
+				return true
+			}
+			return false
+		},
+	}, nil
+}
+
+// AllowRegexp returns an OK that allows only paths matching one of the given
+// regular expressions.  Expressions are matched against cleaned, absolute
+// paths, and are not anchored unless they say so.  Since there is no telling
+// what an expression might match, every directory is traversable.
+func AllowRegexp(ok okay.OK, res ...*regexp.Regexp) okay.OK {
+	return pathOK{
+		OK: ok,
+		match: func(p string) bool {
+			for _, re := range res {
+				if re.MatchString(p) {
+					return true
+				}
+			}
+			return false
+		},
+		reach: always,
+	}
+}
+
+// DenyPaths returns an OK that refuses the given paths and everything
+// beneath them, and otherwise allows what ok allows.
+func DenyPaths(ok okay.OK, paths ...string) okay.OK {
+	var ds []string
+	for _, d := range paths {
+		ds = append(ds, cleanPath(d))
+	}
+	permitted := func(p string) bool {
+		for _, d := range ds {
+			if under(p, d) {
+				return false
+			}
+		}
+		return true
+	}
+	return pathOK{OK: ok, match: permitted, reach: permitted}
+}
@@ -0,0 +1,221 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/google/okay"
+)
+
+func TestPathOKs(t *testing.T) {
+	glob, err := AllowGlob(allowAll(okay.New()), "/logs/*.log", "logs/old/../archive/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		desc  string
+		ok    okay.OK
+		allow []string
+		deny  []string
+	}{
+		{
+			desc:  "prefix",
+			ok:    AllowPrefix(allowAll(okay.New()), "/logs"),
+			allow: []string{"/logs", "logs/a", "/logs2", "/x/../logs/a"},
+			deny:  []string{"/log", "/other/logs", "/logs/../etc/passwd"},
+		},
+		{
+			desc:  "prefix with trailing slash",
+			ok:    AllowPrefix(allowAll(okay.New()), "/logs/"),
+			allow: []string{"/logs/a", "logs/a/b"},
+			deny:  []string{"/logs", "/logs2"},
+		},
+		{
+			desc:  "subtree",
+			ok:    AllowSubtree(allowAll(okay.New()), "/logs/", "/tmp/a"),
+			allow: []string{"/logs", "/logs/", "logs/a/b", "/tmp/a", "/tmp/./a/b"},
+			deny:  []string{"/logs2", "/tmp", "/tmp/ab", "/logs/../tmp"},
+		},
+		{
+			desc:  "root subtree",
+			ok:    AllowSubtree(allowAll(okay.New()), "/"),
+			allow: []string{"/", "/a", "a/b/c"},
+		},
+		{
+			desc:  "files and subtrees",
+			ok:    AllowPaths(allowAll(okay.New()), []string{"/readme.txt", "docs"}, []string{"/reports"}),
+			allow: []string{"/readme.txt", "/docs", "/reports", "/reports/q1.csv"},
+			deny:  []string{"/readme.txt/x", "/docs/a", "/readme", "/reports2"},
+		},
+		{
+			desc:  "glob",
+			ok:    glob,
+			allow: []string{"/logs/a.log", "logs/b.log", "/logs/archive/x"},
+			deny:  []string{"/logs/a.txt", "/logs/sub/a.log", "/logs/old/x", "/logs/../a.log"},
+		},
+		{
+			desc:  "regexp",
+			ok:    AllowRegexp(allowAll(okay.New()), regexp.MustCompile(`^/reports/q[1-4]\.csv$`)),
+			allow: []string{"/reports/q1.csv", "reports//q4.csv"},
+			deny:  []string{"/reports/q5.csv", "/x/../../reports/q1.csv.bak"},
+		},
+		{
+			desc:  "deny",
+			ok:    DenyPaths(allowAll(okay.New()), "/secret", "private/"),
+			allow: []string{"/", "/public", "/secrets", "/a/secret"},
+			deny:  []string{"/secret", "secret/key", "/x/../secret/key", "/private", "/private/a"},
+		},
+		{
+			desc:  "stacked",
+			ok:    DenyPaths(AllowSubtree(allowAll(okay.New()), "/logs"), "/logs/auth"),
+			allow: []string{"/logs", "/logs/syslog"},
+			deny:  []string{"/etc", "/logs/auth", "/logs/auth/today"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, ent := range table {
+		for _, p := range ent.allow {
+			if got, _ := okay.Check(ctx, p, ent.ok); !got {
+				t.Errorf("%s: %q: denied, want allowed", ent.desc, p)
+			}
+		}
+		for _, p := range ent.deny {
+			if got, _ := okay.Check(ctx, p, ent.ok); got {
+				t.Errorf("%s: %q: allowed, want denied", ent.desc, p)
+			}
+		}
+	}
+}
+
+func TestAllowGlobBadPattern(t *testing.T) {
+	if _, err := AllowGlob(okay.New(), "/logs/["); err == nil {
+		t.Errorf("AllowGlob: got no error for a bad pattern")
+	}
+}
+
+func TestPathOKsThroughView(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	ok := DenyPaths(AllowSubtree(allowAll(okay.New()), "/pub"), "/pub/secret")
+	if _, err := s.AddOK(fs.String(), ok); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	table := []struct {
+		path string
+		want bool
+	}{
+		{"pub/a", true},
+		{"/pub/../pub/a", true},
+		{"pub/secret", false},
+		{"pub/./secret", false},
+		{"other", false},
+		{"pub/../other", false},
+	}
+	for _, ent := range table {
+		if got := v.access(ctx, ent.path); got != ent.want {
+			t.Errorf("access(%q): got %v, want %v", ent.path, got, ent.want)
+		}
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	glob, err := AllowGlob(allowAll(okay.New()), "/logs/*/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		desc string
+		ok   okay.OK
+		yes  []string
+		no   []string
+	}{
+		{
+			desc: "unrestricted",
+			ok:   allowAll(okay.New()),
+			yes:  []string{"/", "/anything"},
+		},
+		{
+			desc: "prefix",
+			ok:   AllowPrefix(allowAll(okay.New()), "/pub/docs"),
+			yes:  []string{"/", "/pub", "/pub/docs", "/pub/docs2", "/pub/docs/a"},
+			no:   []string{"/priv", "/pu"},
+		},
+		{
+			desc: "subtree",
+			ok:   AllowSubtree(allowAll(okay.New()), "/pub/docs"),
+			yes:  []string{"/", "pub", "/pub/docs", "/pub/docs/a"},
+			no:   []string{"/priv", "/pub/docs2"},
+		},
+		{
+			desc: "files and subtrees",
+			ok:   AllowPaths(allowAll(okay.New()), []string{"/pub/a/f"}, []string{"/docs"}),
+			yes:  []string{"/", "/pub", "/pub/a", "/docs", "/docs/sub"},
+			no:   []string{"/priv", "/pub/b", "/pub/a/f/g"},
+		},
+		{
+			desc: "glob",
+			ok:   glob,
+			yes:  []string{"/", "/logs", "/logs/web"},
+			no:   []string{"/pub", "/logs/web/app.log", "/logs/web/sub"},
+		},
+		{
+			desc: "deny",
+			ok:   DenyPaths(allowAll(okay.New()), "/secret"),
+			yes:  []string{"/", "/pub"},
+			no:   []string{"/secret", "/secret/sub"},
+		},
+		{
+			desc: "plain allow",
+			ok: okay.Allow(allowAll(okay.New()), func(p interface{}) (bool, error) {
+				s, ok := p.(string)
+				return ok && s == "/pub/a", nil
+			}),
+			no: []string{"/", "/pub"},
+		},
+	}
+	ctx := context.Background()
+	for _, ent := range table {
+		for _, p := range ent.yes {
+			if got, _ := okay.Check(ctx, Traversal(p), ent.ok); !got {
+				t.Errorf("%s: Traversal(%q): refused, want allowed", ent.desc, p)
+			}
+		}
+		for _, p := range ent.no {
+			if got, _ := okay.Check(ctx, Traversal(p), ent.ok); got {
+				t.Errorf("%s: Traversal(%q): allowed, want refused", ent.desc, p)
+			}
+		}
+	}
+}
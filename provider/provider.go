@@ -0,0 +1,141 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package provider defines the interface implemented by identity providers,
+// and a registry that maps grant schemes to providers.
+package provider
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/google/okay"
+)
+
+// A Provider authenticates users with some external identity service.
+type Provider interface {
+	// Name is the scheme used for this provider in grants, such as "google".
+	Name() string
+
+	// Title is a human-readable name, such as "Google".
+	Title() string
+
+	// RegisterHandlers registers the handlers for the sign-in flow on mux.
+	// The given path is the landing URL that begins the flow, and users are
+	// sent to home once they have signed in or out.
+	RegisterHandlers(mux *http.ServeMux, path, home string) error
+
+	// LogoutURL is the path that signs the user out.
+	LogoutURL() string
+
+	// Context returns a context that is updated with the credentials carried
+	// by the given request, if any.  If ctx carries the request's response
+	// writer (see WithResponseWriter), renewed credentials may be sent back
+	// through it.
+	Context(ctx context.Context, r *http.Request) context.Context
+
+	// Show reports the value of the verified credentials in ctx, if any.
+	Show(ctx context.Context) (string, bool)
+
+	// Verify returns an OK that verifies users matching any of the given
+	// principals.  The meaning of a principal is up to the provider.
+	Verify(ok okay.OK, principals ...string) okay.OK
+}
+
+// A PrincipalChecker is a Provider that can reject malformed principals, so
+// that grants naming them fail to parse rather than never verifying.
+type PrincipalChecker interface {
+	CheckPrincipal(principal string) error
+}
+
+type writerKey struct{}
+
+// WithResponseWriter returns a context carrying w, the writer for the
+// response to the request a Provider's Context reads.
+func WithResponseWriter(ctx context.Context, w http.ResponseWriter) context.Context {
+	return context.WithValue(ctx, writerKey{}, w)
+}
+
+// ResponseWriter returns the writer carried by ctx, if any.
+func ResponseWriter(ctx context.Context) (http.ResponseWriter, bool) {
+	w, ok := ctx.Value(writerKey{}).(http.ResponseWriter)
+	return w, ok
+}
+
+// A Registry maps grant schemes to providers.  Each server keeps its own,
+// so that servers configured with different providers do not interfere.  A
+// nil Registry has no providers.
+type Registry struct {
+	mu        sync.Mutex
+	providers map[string]Provider
+}
+
+// NewRegistry returns a Registry holding the given providers.
+func NewRegistry(ps ...Provider) *Registry {
+	r := &Registry{providers: make(map[string]Provider)}
+	for _, p := range ps {
+		r.Register(p)
+	}
+	return r
+}
+
+// Register makes a provider available under its name.  It replaces any
+// provider previously registered with the same name.
+func (r *Registry) Register(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[p.Name()] = p
+}
+
+// Lookup returns the provider registered under the given name.
+func (r *Registry) Lookup(name string) (Provider, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Names lists the names of all registered providers.
+func (r *Registry) Names() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Verify returns an OK that verifies principals with the named provider.
+// The provider is looked up each time the OK is verified, so it need not be
+// registered until it is first used.  An OK naming a provider that has not
+// been registered never verifies.
+func (r *Registry) Verify(ok okay.OK, name string, principals ...string) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		p, ok := r.Lookup(name)
+		if !ok {
+			return false, nil
+		}
+		return p.Verify(okay.New(), principals...).Verify(ctx)
+	})
+}
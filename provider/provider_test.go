@@ -0,0 +1,92 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/okay"
+)
+
+type ctxKey int
+
+// fake verifies users whose name is stored in the context.
+type fake string
+
+func (f fake) Name() string                                                 { return string(f) }
+func (f fake) Title() string                                                { return string(f) }
+func (f fake) RegisterHandlers(*http.ServeMux, string, string) error        { return nil }
+func (f fake) LogoutURL() string                                            { return "" }
+func (f fake) Context(ctx context.Context, _ *http.Request) context.Context { return ctx }
+
+func (f fake) Show(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(ctxKey(0)).(string)
+	return user, ok
+}
+
+func (f fake) Verify(ok okay.OK, principals ...string) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		user, ok := f.Show(ctx)
+		if !ok {
+			return false, nil
+		}
+		for _, p := range principals {
+			if p == user {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func TestVerify(t *testing.T) {
+	r := NewRegistry()
+	ok := r.Verify(okay.New(), "fake", "alice")
+	ctx := context.WithValue(context.Background(), ctxKey(0), "alice")
+
+	// The OK is built before the provider exists, and must not verify
+	// until it does.
+	if v, _ := ok.Verify(ctx); v {
+		t.Errorf("Verify before Register: got true, want false")
+	}
+
+	r.Register(fake("fake"))
+	if p, found := r.Lookup("fake"); !found || p.Name() != "fake" {
+		t.Errorf("Lookup(fake): got %v, %v", p, found)
+	}
+	if v, _ := ok.Verify(ctx); !v {
+		t.Errorf("Verify(alice): got false, want true")
+	}
+	bob := context.WithValue(context.Background(), ctxKey(0), "bob")
+	if v, _ := ok.Verify(bob); v {
+		t.Errorf("Verify(bob): got true, want false")
+	}
+}
+
+func TestRegistriesAreSeparate(t *testing.T) {
+	a, b := NewRegistry(fake("fake")), NewRegistry()
+	if _, found := b.Lookup("fake"); found {
+		t.Errorf("Lookup(fake) in another registry: found it")
+	}
+	if got := a.Names(); len(got) != 1 || got[0] != "fake" {
+		t.Errorf("Names: got %v, want [fake]", got)
+	}
+	var nilReg *Registry
+	if _, found := nilReg.Lookup("fake"); found {
+		t.Errorf("Lookup(fake) in a nil registry: found it")
+	}
+}
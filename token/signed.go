@@ -0,0 +1,204 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package token
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/okay"
+	"github.com/kurin/visage"
+)
+
+var (
+	ErrBadSignature = errors.New("token: bad signature")
+	ErrExpired      = errors.New("token: expired")
+)
+
+// A Claim describes the access granted by a signed token.
+type Claim struct {
+	// FileSystem is the name of the file system the token applies to.
+	FileSystem string `json:"fs"`
+
+	// Path is the file the token grants access to.  If Prefix is set, the
+	// token grants access to Path and everything beneath it.
+	Path   string `json:"p"`
+	Prefix bool   `json:"pfx,omitempty"`
+
+	// Expires is the time after which the token is no longer accepted.
+	Expires time.Time `json:"exp"`
+
+	// MaxUses, if positive, limits the number of times the token can be used.
+	MaxUses int `json:"n,omitempty"`
+
+	// ID distinguishes otherwise identical claims, so that their uses are
+	// counted separately.  Sign fills it in if it is empty.
+	ID string `json:"id"`
+}
+
+func (c Claim) covers(fs, p string) bool {
+	if fs != c.FileSystem {
+		return false
+	}
+	want := path.Clean("/" + c.Path)
+	p = path.Clean("/" + p)
+	if p == want {
+		return true
+	}
+	if !c.Prefix {
+		return false
+	}
+	return want == "/" || strings.HasPrefix(p, want+"/")
+}
+
+// Sign returns a token, suitable for use in a URL, that carries the given
+// claim and is signed with key.
+func Sign(key []byte, c Claim) (string, error) {
+	if c.ID == "" {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		c.ID = base64.RawURLEncoding.EncodeToString(b)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac(key, payload)), nil
+}
+
+// Parse checks the signature and expiry of the given token, and returns its
+// claim.
+func Parse(key []byte, tok string) (Claim, error) {
+	i := strings.LastIndex(tok, ".")
+	if i < 0 {
+		return Claim{}, ErrBadSignature
+	}
+	payload, sig := tok[:i], tok[i+1:]
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return Claim{}, ErrBadSignature
+	}
+	if !hmac.Equal(got, mac(key, payload)) {
+		return Claim{}, ErrBadSignature
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Claim{}, fmt.Errorf("token: %v", err)
+	}
+	var c Claim
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Claim{}, fmt.Errorf("token: %v", err)
+	}
+	if !c.Expires.IsZero() && !time.Now().Before(c.Expires) {
+		return Claim{}, ErrExpired
+	}
+	return c, nil
+}
+
+func mac(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+type signedKey struct{}
+
+// SignedContext returns a new context that carries the given signed token.
+// The token is not checked until it is verified by an OK.
+func SignedContext(ctx context.Context, tok string) context.Context {
+	return context.WithValue(ctx, signedKey{}, tok)
+}
+
+// VerifiesSigned returns a new OK that verifies access with tokens signed by
+// key.  The OK must be consulted through a visage.View, because the claim is
+// matched against the file system and path being accessed.  Only real
+// accesses count towards a token's MaxUses; the probes a View makes to stat
+// or list paths do not.
+func VerifiesSigned(ok okay.OK, key []byte) okay.OK {
+	u := &uses{m: make(map[string]use)}
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		tok, ok := ctx.Value(signedKey{}).(string)
+		if !ok {
+			return false, nil
+		}
+		fs, p, ok := visage.Resource(ctx)
+		if !ok {
+			return false, nil
+		}
+		c, err := Parse(key, tok)
+		if err != nil {
+			return false, nil
+		}
+		if !c.covers(fs, p) {
+			return false, nil
+		}
+		if c.MaxUses <= 0 {
+			return true, nil
+		}
+		return u.spend(c, visage.Accessing(ctx)), nil
+	})
+}
+
+// uses counts the uses of claims with a MaxUses, by ID.
+type uses struct {
+	mu sync.Mutex
+	m  map[string]use
+}
+
+type use struct {
+	n       int
+	expires time.Time
+}
+
+// spend reports whether c has uses left, and if access is set, uses one.
+func (u *uses) spend(c Claim, access bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	e, ok := u.m[c.ID]
+	if e.n >= c.MaxUses {
+		return false
+	}
+	if !access {
+		return true
+	}
+	if !ok {
+		// Expired claims no longer parse, so their counts can be dropped.
+		// Doing so as new claims arrive keeps the map to the live ones.
+		now := time.Now()
+		for id, e := range u.m {
+			if !e.expires.IsZero() && !now.Before(e.expires) {
+				delete(u.m, id)
+			}
+		}
+		e.expires = c.Expires
+	}
+	e.n++
+	u.m[c.ID] = e
+	return true
+}
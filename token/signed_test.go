@@ -0,0 +1,237 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package token
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+	"github.com/kurin/visage"
+)
+
+func TestParse(t *testing.T) {
+	key := []byte("secret")
+	good, err := Sign(key, Claim{FileSystem: "fs", Path: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := Sign(key, Claim{FileSystem: "fs", Path: "a", Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Sign([]byte("other"), Claim{FileSystem: "fs", Path: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		desc string
+		tok  string
+		err  error
+	}{
+		{
+			desc: "good",
+			tok:  good,
+		},
+		{
+			desc: "expired",
+			tok:  expired,
+			err:  ErrExpired,
+		},
+		{
+			desc: "wrong key",
+			tok:  other,
+			err:  ErrBadSignature,
+		},
+		{
+			desc: "tampered",
+			tok:  "x" + good,
+			err:  ErrBadSignature,
+		},
+		{
+			desc: "garbage",
+			tok:  "garbage",
+			err:  ErrBadSignature,
+		},
+	}
+
+	for _, ent := range table {
+		c, err := Parse(key, ent.tok)
+		if err != ent.err {
+			t.Errorf("%s: got %v, want %v", ent.desc, err, ent.err)
+			continue
+		}
+		if err == nil && (c.FileSystem != "fs" || c.Path != "a" || c.ID == "") {
+			t.Errorf("%s: got claim %+v", ent.desc, c)
+		}
+	}
+}
+
+func TestVerifiesSigned(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, p := range []string{"dir/a", "dir/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(d, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, p), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := []byte("secret")
+	s := visage.New()
+	if err := s.AddFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(d, VerifiesSigned(okay.New(), key)); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		desc  string
+		claim Claim
+		key   []byte
+		opens map[string]bool
+	}{
+		{
+			desc:  "single file",
+			claim: Claim{FileSystem: d, Path: "c"},
+			opens: map[string]bool{"c": true, "dir/a": false},
+		},
+		{
+			desc:  "prefix",
+			claim: Claim{FileSystem: d, Path: "dir", Prefix: true},
+			opens: map[string]bool{"dir/a": true, "/dir/b": true, "c": false},
+		},
+		{
+			desc:  "prefix does not cover siblings",
+			claim: Claim{FileSystem: d, Path: "di", Prefix: true},
+			opens: map[string]bool{"dir/a": false},
+		},
+		{
+			desc:  "wrong file system",
+			claim: Claim{FileSystem: "/elsewhere", Path: "c"},
+			opens: map[string]bool{"c": false},
+		},
+		{
+			desc:  "wrong key",
+			claim: Claim{FileSystem: d, Path: "c"},
+			key:   []byte("other"),
+			opens: map[string]bool{"c": false},
+		},
+	}
+
+	for _, ent := range table {
+		k := key
+		if ent.key != nil {
+			k = ent.key
+		}
+		tok, err := Sign(k, ent.claim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := SignedContext(context.Background(), tok)
+		for p, want := range ent.opens {
+			r, err := v.Open(ctx, p)
+			if err == nil {
+				r.Close()
+			}
+			if got := err == nil; got != want {
+				t.Errorf("%s: Open(%q): got %v, want success %v", ent.desc, p, err, want)
+			}
+		}
+	}
+}
+
+func TestVerifiesSignedMaxUses(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("secret")
+	s := visage.New()
+	if err := s.AddFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(d, VerifiesSigned(okay.New(), key)); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := Sign(key, Claim{FileSystem: d, Path: "f", MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := SignedContext(context.Background(), tok)
+	// Stats and listings only probe the path, and do not spend uses.
+	for i := 0; i < 3; i++ {
+		if _, err := v.Stat(ctx, "f"); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		r, err := v.Open(ctx, "f")
+		if err != nil {
+			t.Fatalf("use %d: %v", i+1, err)
+		}
+		r.Close()
+	}
+	if _, err := v.Open(ctx, "f"); err != visage.ErrNoAccess {
+		t.Errorf("use 3: got %v, want %v", err, visage.ErrNoAccess)
+	}
+}
+
+func TestUsesPrunesExpired(t *testing.T) {
+	u := &uses{m: make(map[string]use)}
+	now := time.Now()
+	table := []Claim{
+		{ID: "old", MaxUses: 1, Expires: now.Add(-time.Minute)},
+		{ID: "forever", MaxUses: 1},
+		{ID: "new", MaxUses: 1, Expires: now.Add(time.Hour)},
+	}
+	for _, c := range table {
+		if !u.spend(c, true) {
+			t.Errorf("spend(%s): refused, want allowed", c.ID)
+		}
+	}
+	if _, ok := u.m["old"]; ok {
+		t.Errorf("expired claim is still counted")
+	}
+	for _, id := range []string{"forever", "new"} {
+		if _, ok := u.m[id]; !ok {
+			t.Errorf("%s: count dropped before the claim expired", id)
+		}
+	}
+}
@@ -30,26 +30,69 @@ import (
 
 var (
 	ErrNoAccess = errors.New("access denied")
+
+	// ErrRemoved is returned by a View whose file system has been removed or
+	// replaced since the View was created.
+	ErrRemoved = errors.New("file system removed")
 )
 
 type Share struct {
-	fs  map[string]FileSystem
-	oks map[string][]okay.OK
-	mux sync.Mutex
+	fs   map[string]FileSystem
+	done map[string]chan struct{}
+	oks  map[string][]RegisteredOK
+	next OKID
+	mux  sync.Mutex
 }
 
 func New() *Share {
 	return &Share{
-		fs:  make(map[string]FileSystem),
-		oks: make(map[string][]okay.OK),
+		fs:   make(map[string]FileSystem),
+		done: make(map[string]chan struct{}),
+		oks:  make(map[string][]RegisteredOK),
 	}
 }
 
+// An OKID identifies an OK registered with a Share.  IDs are unique for the
+// lifetime of the Share.
+type OKID uint64
+
+// RegisteredOK describes an OK that has been added to a file system.
+type RegisteredOK struct {
+	ID    OKID
+	OK    okay.OK
+	Write bool
+}
+
 type View struct {
-	s  *Share
-	fs FileSystem
+	// Listing controls which entries ReadDir shows.
+	Listing Listing
+
+	// Conceal, if set, makes the View report paths the caller cannot access
+	// as not found, rather than returning ErrNoAccess, so that callers
+	// cannot learn which paths exist.
+	Conceal bool
+
+	s    *Share
+	fs   FileSystem
+	fsc  FileSystemContext
+	done <-chan struct{}
 }
 
+// A Listing controls which entries of a directory a View shows.
+type Listing int
+
+const (
+	// HideDenied omits the entries a caller can neither access nor
+	// traverse, so that their names are not revealed.  It is the default.
+	HideDenied Listing = iota
+
+	// ShowNames shows every entry of a directory the caller has been
+	// granted, though opening those the caller cannot access still fails.
+	// Directories that are only traversable are still filtered, so that
+	// granting one file does not reveal the names of everything around it.
+	ShowNames
+)
+
 // FileSystem specifies the abstraction that backends must satisfy.
 type FileSystem interface {
 	// String is a unique, descriptive identifier for this file system.
@@ -92,6 +135,52 @@ func (s *Share) AddFileSystem(fs FileSystem) error {
 		return fmt.Errorf("visage: %s: file system already registered", fs.String())
 	}
 	s.fs[fs.String()] = fs
+	s.done[fs.String()] = make(chan struct{})
+	return nil
+}
+
+// RemoveFileSystem unregisters the named file system and discards all of its
+// OKs.  Views of the file system return ErrRemoved from subsequent calls;
+// readers and writers that are already open are left to finish.
+func (s *Share) RemoveFileSystem(fs string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fs[fs]; !ok {
+		return fmt.Errorf("visage: %s: file system not registered", fs)
+	}
+	close(s.done[fs])
+	delete(s.done, fs)
+	delete(s.fs, fs)
+	delete(s.oks, fs)
+	return nil
+}
+
+// ReplaceFileSystem swaps the named file system for another backend.  The OKs
+// registered for the old file system are carried over to the new one.  As
+// with RemoveFileSystem, existing Views of the old file system return
+// ErrRemoved.
+func (s *Share) ReplaceFileSystem(old string, fs FileSystem) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fs[old]; !ok {
+		return fmt.Errorf("visage: %s: file system not registered", old)
+	}
+	if _, ok := s.fs[fs.String()]; ok && fs.String() != old {
+		return fmt.Errorf("visage: %s: file system already registered", fs.String())
+	}
+	oks := s.oks[old]
+	close(s.done[old])
+	delete(s.done, old)
+	delete(s.fs, old)
+	delete(s.oks, old)
+
+	s.fs[fs.String()] = fs
+	s.done[fs.String()] = make(chan struct{})
+	if len(oks) > 0 {
+		s.oks[fs.String()] = oks
+	}
 	return nil
 }
 
@@ -116,74 +205,382 @@ func (s *Share) View(fs string) (*View, error) {
 	}
 
 	return &View{
-		s:  s,
-		fs: f,
+		s:    s,
+		fs:   f,
+		fsc:  ToContext(f),
+		done: s.done[fs],
 	}, nil
 }
 
-func (s *Share) AddOK(fs string, ok okay.OK) error {
+// AddOK registers an OK that grants read access to the given file system.
+// The returned ID can be passed to RevokeOK.
+func (s *Share) AddOK(fs string, ok okay.OK) (OKID, error) {
+	return s.addOK(fs, ok, false)
+}
+
+// AddWriteOK registers an OK that grants write access to the given file
+// system.  Write access is tracked separately from read access; an OK added
+// with AddOK never allows a caller to create files.
+func (s *Share) AddWriteOK(fs string, ok okay.OK) (OKID, error) {
+	return s.addOK(fs, ok, true)
+}
+
+func (s *Share) addOK(fs string, ok okay.OK, write bool) (OKID, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
 	if _, ok := s.fs[fs]; !ok {
-		return fmt.Errorf("visage: %s: no such file system", fs)
+		return 0, fmt.Errorf("visage: %s: no such file system", fs)
 	}
-	s.oks[fs] = append(s.oks[fs], ok)
-	return nil
+	s.next++
+	s.oks[fs] = append(s.oks[fs], RegisteredOK{
+		ID:    s.next,
+		OK:    ok,
+		Write: write,
+	})
+	return s.next, nil
 }
 
-func (v *View) oks() []okay.OK {
+// RevokeOK removes the OK with the given ID.  Access checks that begin after
+// RevokeOK returns will not consult it.
+func (s *Share) RevokeOK(id OKID) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for fs, oks := range s.oks {
+		for i, rok := range oks {
+			if rok.ID != id {
+				continue
+			}
+			// Copy rather than splice, so that slices handed out by OKs are
+			// not modified underneath the caller.
+			n := make([]RegisteredOK, 0, len(oks)-1)
+			n = append(n, oks[:i]...)
+			s.oks[fs] = append(n, oks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("visage: %d: no such OK", id)
+}
+
+// OKs lists the OKs registered for the given file system, in the order they
+// were added.
+func (s *Share) OKs(fs string) ([]RegisteredOK, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fs[fs]; !ok {
+		return nil, fmt.Errorf("visage: %s: no such file system", fs)
+	}
+	oks := make([]RegisteredOK, len(s.oks[fs]))
+	copy(oks, s.oks[fs])
+	return oks, nil
+}
+
+func (v *View) oks(write bool) []okay.OK {
 	var oks []okay.OK
 	v.s.mux.Lock()
-	for _, ok := range v.s.oks[v.fs.String()] {
-		oks = append(oks, ok)
+	for _, rok := range v.s.oks[v.fs.String()] {
+		if rok.Write == write {
+			oks = append(oks, rok.OK)
+		}
 	}
 	v.s.mux.Unlock()
 	return oks
 }
 
-func (v *View) access(ctx context.Context, path string) bool {
-	ok, _ := okay.Check(ctx, path, v.oks()...)
+type ctxKey int
+
+const resourceKey ctxKey = 0
+
+type resource struct {
+	fs, path string
+	access   bool
+}
+
+// Resource reports the file system and path whose access is being checked.
+// It is meant to be called from an OK's verifier, which otherwise sees only
+// the caller's context.
+func Resource(ctx context.Context) (fs, path string, ok bool) {
+	r, ok := ctx.Value(resourceKey).(resource)
+	if !ok {
+		return "", "", false
+	}
+	return r.fs, r.path, true
+}
+
+// Accessing reports whether the check in progress is for a real access of
+// the resource, rather than one made to decide what to show, such as a Probe
+// or Traversal.  Verifiers that count uses should count only these.
+func Accessing(ctx context.Context) bool {
+	r, ok := ctx.Value(resourceKey).(resource)
+	return ok && r.access
+}
+
+// check reports whether any of oks allows res, which concerns path.  Only a
+// string res is an access.
+func (v *View) check(ctx context.Context, path string, res interface{}, oks []okay.OK) bool {
+	_, access := res.(string)
+	return v.ask(ctx, path, res, access, oks)
+}
+
+// ask is check, but says explicitly whether res is an access.
+func (v *View) ask(ctx context.Context, path string, res interface{}, access bool, oks []okay.OK) bool {
+	ctx = context.WithValue(ctx, resourceKey, resource{fs: v.fs.String(), path: path, access: access})
+	ok, _ := okay.Check(ctx, res, oks...)
 	return ok
 }
 
+func (v *View) access(ctx context.Context, path string) bool {
+	return v.check(ctx, path, path, v.oks(false))
+}
+
+func (v *View) writeAccess(ctx context.Context, path string) bool {
+	return v.check(ctx, path, path, v.oks(true))
+}
+
+// probe reports whether the caller could access path, without accessing it.
+// It asks with a Probe, but falls back to the path itself for OKs that do
+// not recognize Probes; Accessing reports false for both.
+func (v *View) probe(ctx context.Context, path string, oks []okay.OK) bool {
+	return v.check(ctx, path, Probe(path), oks) || v.ask(ctx, path, path, false, oks)
+}
+
+// visible reports whether path should be shown to the caller: either it
+// could be accessed, or it is a directory with something accessible beneath
+// it.
+func (v *View) visible(ctx context.Context, path string, dir bool, oks []okay.OK) bool {
+	if v.probe(ctx, path, oks) {
+		return true
+	}
+	return dir && v.check(ctx, path, Traversal(path), oks)
+}
+
+// denied returns the error for an operation on path that the caller may
+// not make.
+func (v *View) denied(op, path string) error {
+	if v.Conceal {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	return ErrNoAccess
+}
+
+// removed reports whether the View's file system has been removed from the
+// Share.
+func (v *View) removed() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (v View) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	if v.removed() {
+		return nil, ErrRemoved
+	}
 	if !v.access(ctx, path) {
-		return nil, ErrNoAccess
+		return nil, v.denied("open", path)
 	}
-	return v.fs.Open(path)
+	return v.fsc.OpenContext(ctx, path)
 }
 
+// Create returns a writer for the given path, if the context has been granted
+// write access with AddWriteOK.
+func (v View) Create(ctx context.Context, path string) (io.WriteCloser, error) {
+	if v.removed() {
+		return nil, ErrRemoved
+	}
+	if !v.writeAccess(ctx, path) {
+		return nil, v.denied("open", path)
+	}
+	return v.fsc.CreateContext(ctx, path)
+}
+
+// ReadDir returns the entries of the given directory that the caller can
+// see.  A directory can be read if it is granted, or if anything beneath it
+// is; its entries are those that are granted, and the directories beneath
+// which something is granted.  Use the path helpers, such as AllowSubtree,
+// to grant a directory together with its descendants.  See Listing for how
+// to show the names of entries that cannot be accessed.
 func (v View) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
-	if !v.access(ctx, path) {
-		return nil, ErrNoAccess
+	if v.removed() {
+		return nil, ErrRemoved
+	}
+	oks := v.oks(false)
+	granted := v.probe(ctx, path, oks)
+	if !granted && !v.check(ctx, path, Traversal(path), oks) {
+		return nil, v.denied("open", path)
+	}
+	fis, err := v.fsc.ReadDirContext(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if granted && v.Listing == ShowNames {
+		return fis, nil
 	}
-	return v.fs.ReadDir(path)
+	var rtn []os.FileInfo
+	for _, fi := range fis {
+		if v.visible(ctx, filepath.Join(path, fi.Name()), fi.IsDir(), oks) {
+			rtn = append(rtn, fi)
+		}
+	}
+	return rtn, nil
 }
 
-func (v View) List(ctx context.Context) ([]string, error) {
-	oks := v.oks()
+// Stat describes the given path, if the caller can see it: if it is granted,
+// or if it is a directory with something granted beneath it.  Stat is not
+// counted as an access of path.
+func (v View) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	if v.removed() {
+		return nil, ErrRemoved
+	}
+	oks := v.oks(false)
+	granted := v.probe(ctx, path, oks)
+	fi, err := v.fsc.StatContext(ctx, path)
+	if !granted && (err != nil || !fi.IsDir() || !v.check(ctx, path, Traversal(path), oks)) {
+		// Don't reveal whether an inaccessible path exists.
+		return nil, v.denied("stat", path)
+	}
+	return fi, err
+}
 
-	var files []string
-	if err := Walk(v.fs, "", func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			if fi.IsDir() {
-				return filepath.SkipDir
-			}
-			return err
+// Walk is like the package's Walk, but visits only what the caller can see,
+// as ReadDir does with the HideDenied listing.  It stops with the context's
+// error if the context is canceled.
+func (v View) Walk(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	v.Listing = HideDenied
+	return Walk(viewFS{v: &v, ctx: ctx}, root, func(path string, fi os.FileInfo, err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
 		}
+		return fn(path, fi, err)
+	})
+}
 
-		if fi.IsDir() {
-			return nil
+// viewFS presents a View as a FileSystem, for walking.
+type viewFS struct {
+	v   *View
+	ctx context.Context
+}
+
+func (f viewFS) String() string                             { return f.v.fs.String() }
+func (f viewFS) Open(path string) (io.ReadCloser, error)    { return f.v.Open(f.ctx, path) }
+func (f viewFS) Create(path string) (io.WriteCloser, error) { return f.v.Create(f.ctx, path) }
+func (f viewFS) Stat(path string) (os.FileInfo, error)      { return f.v.Stat(f.ctx, path) }
+func (f viewFS) ReadDir(path string) ([]os.FileInfo, error) { return f.v.ReadDir(f.ctx, path) }
+
+// ListOptions control a call to List.
+type ListOptions struct {
+	// Start is the directory to list files beneath.  It defaults to the
+	// root of the file system.
+	Start string
+
+	// PageSize, if positive, limits the number of files returned.
+	PageSize int
+
+	// Cursor continues a previous listing from where it stopped.  It must
+	// be a cursor returned by List with the same Start.
+	Cursor string
+}
+
+// errPageFull stops a listing once a page has been filled.
+var errPageFull = errors.New("page full")
+
+// List returns the files beneath opts.Start that the caller can access, in
+// lexical order of their paths.  If the page fills up before the listing is
+// complete, List also returns a cursor for the next page; a later page may
+// turn out to be empty.  Directories beneath which nothing is granted are
+// not read, and List stops with the context's error if it is canceled.
+func (v View) List(ctx context.Context, opts ListOptions) ([]string, string, error) {
+	if v.removed() {
+		return nil, "", ErrRemoved
+	}
+	var after []string
+	if opts.Cursor != "" {
+		start, cur := cleanPath(opts.Start), cleanPath(opts.Cursor)
+		if cur == start || !under(cur, start) {
+			return nil, "", fmt.Errorf("visage: %s: cursor is not beneath %q", opts.Cursor, opts.Start)
 		}
+		after = segments(cur)[len(segments(start)):]
+	}
+	l := &lister{
+		v:     &v,
+		ctx:   ctx,
+		oks:   v.oks(false),
+		limit: opts.PageSize,
+	}
+	if !v.visible(ctx, opts.Start, true, l.oks) {
+		return nil, "", v.denied("open", opts.Start)
+	}
+	switch err := l.dir(opts.Start, after); err {
+	case nil:
+		return l.files, "", nil
+	case errPageFull:
+		return l.files, l.files[len(l.files)-1], nil
+	default:
+		return nil, "", err
+	}
+}
 
-		if ok, _ := okay.Check(ctx, path, oks...); ok {
-			files = append(files, path)
-			return nil
+type lister struct {
+	v     *View
+	ctx   context.Context
+	oks   []okay.OK
+	limit int
+	files []string
+}
+
+// dir lists the files beneath path.  If after is set, it holds the
+// remaining elements of the cursor, and only what follows it is listed.
+func (l *lister) dir(path string, after []string) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	if l.v.removed() {
+		return ErrRemoved
+	}
+	fis, err := l.v.fsc.ReadDirContext(l.ctx, path)
+	if err != nil {
+		if ctxErr := l.ctx.Err(); ctxErr != nil {
+			return ctxErr
 		}
+		// As with Walk, unreadable directories are skipped.
 		return nil
-	}); err != nil {
-		return nil, err
 	}
-	return files, nil
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	for _, fi := range fis {
+		name := fi.Name()
+		var rest []string
+		if after != nil {
+			if name < after[0] {
+				continue
+			}
+			if name == after[0] {
+				if len(after) == 1 || !fi.IsDir() {
+					continue
+				}
+				rest = after[1:]
+			}
+		}
+		p := filepath.Join(path, name)
+		if fi.IsDir() {
+			if !l.v.visible(l.ctx, p, true, l.oks) {
+				continue
+			}
+			if err := l.dir(p, rest); err != nil {
+				return err
+			}
+			continue
+		}
+		if !l.v.probe(l.ctx, p, l.oks) {
+			continue
+		}
+		l.files = append(l.files, p)
+		if l.limit > 0 && len(l.files) >= l.limit {
+			return errPageFull
+		}
+	}
+	return nil
 }
@@ -0,0 +1,876 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+)
+
+func allowAll(ok okay.OK) okay.OK {
+	return okay.Verify(ok, func(context.Context) (bool, error) { return true, nil })
+}
+
+func TestViewCreate(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := v.Create(ctx, "file"); err != ErrNoAccess {
+		t.Errorf("Create with no OKs: got %v, want %v", err, ErrNoAccess)
+	}
+
+	if _, err := s.AddOK(fs.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Create(ctx, "file"); err != ErrNoAccess {
+		t.Errorf("Create with read OK: got %v, want %v", err, ErrNoAccess)
+	}
+
+	if _, err := s.AddWriteOK(fs.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	w, err := v.Create(ctx, "file")
+	if err != nil {
+		t.Fatalf("Create with write OK: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := v.Open(ctx, "file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	r.Close()
+}
+
+func TestWriteOKDoesNotGrantRead(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddWriteOK(fs.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	w, err := v.Create(ctx, "dropbox")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w.Close()
+	if _, err := v.Open(ctx, "dropbox"); err != ErrNoAccess {
+		t.Errorf("Open with write OK: got %v, want %v", err, ErrNoAccess)
+	}
+}
+
+func TestRevokeOK(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rid, err := s.AddOK(fs.String(), allowAll(okay.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wid, err := s.AddWriteOK(fs.String(), allowAll(okay.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rid == wid {
+		t.Fatalf("AddOK and AddWriteOK returned the same ID: %d", rid)
+	}
+	oks, err := s.OKs(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oks) != 2 || oks[0].ID != rid || oks[0].Write || oks[1].ID != wid || !oks[1].Write {
+		t.Errorf("OKs: got %+v, want read %d and write %d", oks, rid, wid)
+	}
+
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r, err := v.Open(ctx, "file")
+	if err != nil {
+		t.Fatalf("Open before revocation: %v", err)
+	}
+	r.Close()
+
+	if err := s.RevokeOK(rid); err != nil {
+		t.Fatalf("RevokeOK(%d): %v", rid, err)
+	}
+	if _, err := v.Open(ctx, "file"); err != ErrNoAccess {
+		t.Errorf("Open after revocation: got %v, want %v", err, ErrNoAccess)
+	}
+	if err := s.RevokeOK(rid); err == nil {
+		t.Errorf("RevokeOK(%d) twice: got nil error", rid)
+	}
+	oks, err = s.OKs(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oks) != 1 || oks[0].ID != wid {
+		t.Errorf("OKs after revocation: got %+v, want only %d", oks, wid)
+	}
+}
+
+func TestRemoveFileSystem(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fs.String(), allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r, err := v.Open(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := s.RemoveFileSystem(fs.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Open(ctx, "file"); err != ErrRemoved {
+		t.Errorf("Open after removal: got %v, want %v", err, ErrRemoved)
+	}
+	if _, _, err := v.List(ctx, ListOptions{}); err != ErrRemoved {
+		t.Errorf("List after removal: got %v, want %v", err, ErrRemoved)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "contents" {
+		t.Errorf("reading open file after removal: got %q, %v; want %q", b, err, "contents")
+	}
+	if got := s.FileSystems(); len(got) != 0 {
+		t.Errorf("FileSystems after removal: got %v, want none", got)
+	}
+
+	// Re-adding the file system must not resurrect the old OKs.
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if oks, _ := s.OKs(fs.String()); len(oks) != 0 {
+		t.Errorf("OKs after re-adding: got %d, want 0", len(oks))
+	}
+}
+
+func TestReplaceFileSystem(t *testing.T) {
+	a, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(a)
+	b, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(b)
+	if err := ioutil.WriteFile(filepath.Join(b, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New()
+	if err := s.AddFileSystem(NewDirectory(a)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(a, allowAll(okay.New())); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.View(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReplaceFileSystem(a, NewDirectory(b)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := old.Open(ctx, "file"); err != ErrRemoved {
+		t.Errorf("Open on replaced view: got %v, want %v", err, ErrRemoved)
+	}
+	v, err := s.View(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := v.Open(ctx, "file")
+	if err != nil {
+		t.Fatalf("Open on new view: %v", err)
+	}
+	r.Close()
+}
+
+func TestHierarchy(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, dir := range []string{"pub/docs", "pub/secret", "priv", "logs"} {
+		if err := os.MkdirAll(filepath.Join(d, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"top", "pub/docs/a", "pub/docs/b", "pub/secret/key", "pub/readme", "priv/x", "logs/today.log", "logs/today.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(d, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	glob, err := AllowGlob(allowAll(okay.New()), "/logs/*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		desc    string
+		ok      okay.OK
+		dirs    map[string][]string // directory to visible entries; nil if unreadable
+		list    []string
+		canOpen []string
+	}{
+		{
+			desc: "subtree",
+			ok:   DenyPaths(AllowSubtree(allowAll(okay.New()), "/pub"), "/pub/secret"),
+			dirs: map[string][]string{
+				"":           {"pub"},
+				"pub":        {"docs", "readme"},
+				"pub/docs":   {"a", "b"},
+				"pub/secret": nil,
+				"priv":       nil,
+			},
+			list:    []string{"pub/docs/a", "pub/docs/b", "pub/readme"},
+			canOpen: []string{"pub/readme", "pub/docs/a"},
+		},
+		{
+			desc: "single file",
+			ok:   AllowSubtree(allowAll(okay.New()), "/pub/docs/a"),
+			dirs: map[string][]string{
+				"":         {"pub"},
+				"pub":      {"docs"},
+				"pub/docs": {"a"},
+				"logs":     nil,
+			},
+			list:    []string{"pub/docs/a"},
+			canOpen: []string{"pub/docs/a"},
+		},
+		{
+			desc: "glob",
+			ok:   glob,
+			dirs: map[string][]string{
+				"":     {"logs"},
+				"logs": {"today.log"},
+				"pub":  nil,
+			},
+			list:    []string{"logs/today.log"},
+			canOpen: []string{"logs/today.log"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, ent := range table {
+		s := New()
+		fs := NewDirectory(d)
+		if err := s.AddFileSystem(fs); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AddOK(fs.String(), ent.ok); err != nil {
+			t.Fatal(err)
+		}
+		v, err := s.View(fs.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dir, want := range ent.dirs {
+			fis, err := v.ReadDir(ctx, dir)
+			if want == nil {
+				if err != ErrNoAccess {
+					t.Errorf("%s: ReadDir(%q): got %v, want %v", ent.desc, dir, err, ErrNoAccess)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: ReadDir(%q): %v", ent.desc, dir, err)
+				continue
+			}
+			var got []string
+			for _, fi := range fis {
+				got = append(got, fi.Name())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: ReadDir(%q): got %v, want %v", ent.desc, dir, got, want)
+			}
+		}
+		got, _, err := v.List(ctx, ListOptions{})
+		if err != nil {
+			t.Errorf("%s: List: %v", ent.desc, err)
+		} else if !reflect.DeepEqual(got, ent.list) {
+			t.Errorf("%s: List: got %v, want %v", ent.desc, got, ent.list)
+		}
+		for _, file := range ent.canOpen {
+			r, err := v.Open(ctx, file)
+			if err != nil {
+				t.Errorf("%s: Open(%q): %v", ent.desc, file, err)
+				continue
+			}
+			r.Close()
+		}
+		// Traversable directories can be listed, but not opened.
+		if _, err := v.Open(ctx, "pub/../top"); err != ErrNoAccess {
+			t.Errorf("%s: Open(top): got %v, want %v", ent.desc, err, ErrNoAccess)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := os.MkdirAll(filepath.Join(d, "pub", "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"secret", "pub/a", "pub/secret", "pub/docs/b"} {
+		if err := ioutil.WriteFile(filepath.Join(d, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	ok := DenyPaths(AllowSubtree(allowAll(okay.New()), "/pub"), "/pub/secret")
+	if _, err := s.AddOK(fs.String(), ok); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		listing Listing
+		dir     string
+		want    []string
+	}{
+		{HideDenied, "pub", []string{"a", "docs"}},
+		{ShowNames, "pub", []string{"a", "docs", "secret"}},
+		{HideDenied, "", []string{"pub"}},
+		{ShowNames, "", []string{"pub"}},
+	}
+	ctx := context.Background()
+	for _, ent := range table {
+		v, err := s.View(fs.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Listing = ent.listing
+		fis, err := v.ReadDir(ctx, ent.dir)
+		if err != nil {
+			t.Errorf("ReadDir(%q) with listing %d: %v", ent.dir, ent.listing, err)
+			continue
+		}
+		var got []string
+		for _, fi := range fis {
+			got = append(got, fi.Name())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, ent.want) {
+			t.Errorf("ReadDir(%q) with listing %d: got %v, want %v", ent.dir, ent.listing, got, ent.want)
+		}
+		if _, err := v.Open(ctx, "pub/secret"); err != ErrNoAccess {
+			t.Errorf("Open(pub/secret) with listing %d: got %v, want %v", ent.listing, err, ErrNoAccess)
+		}
+	}
+}
+
+// bigDir is a file system with one directory holding many files.
+type bigDir int
+
+type fileInfo struct {
+	name string
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return 0 }
+func (fi fileInfo) Mode() os.FileMode  { return 0644 }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (b bigDir) String() string                        { return "big" }
+func (b bigDir) Open(string) (io.ReadCloser, error)    { return nil, os.ErrNotExist }
+func (b bigDir) Create(string) (io.WriteCloser, error) { return nil, os.ErrPermission }
+func (b bigDir) Stat(p string) (os.FileInfo, error)    { return fileInfo{name: p, dir: p == ""}, nil }
+func (b bigDir) ReadDir(string) ([]os.FileInfo, error) {
+	fis := make([]os.FileInfo, int(b))
+	for i := range fis {
+		ext := ".txt"
+		if i%2 == 0 {
+			ext = ".log"
+		}
+		fis[i] = fileInfo{name: fmt.Sprintf("file%06d%s", i, ext)}
+	}
+	return fis, nil
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	glob, err := AllowGlob(allowAll(okay.New()), "/*.log")
+	if err != nil {
+		b.Fatal(err)
+	}
+	table := []struct {
+		name    string
+		ok      okay.OK
+		listing Listing
+	}{
+		{"unrestricted", allowAll(okay.New()), HideDenied},
+		{"glob/hide", glob, HideDenied},
+		{"deny/hide", DenyPaths(allowAll(okay.New()), "/file000001.txt"), HideDenied},
+		{"deny/names", DenyPaths(allowAll(okay.New()), "/file000001.txt"), ShowNames},
+	}
+	for _, n := range []int{10000, 50000} {
+		for _, ent := range table {
+			b.Run(fmt.Sprintf("%d/%s", n, ent.name), func(b *testing.B) {
+				s := New()
+				fs := bigDir(n)
+				if err := s.AddFileSystem(fs); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := s.AddOK(fs.String(), ent.ok); err != nil {
+					b.Fatal(err)
+				}
+				v, err := s.View(fs.String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				v.Listing = ent.listing
+				ctx := context.Background()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := v.ReadDir(ctx, ""); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// countingFS records the directories read from a FileSystem.
+type countingFS struct {
+	FileSystem
+
+	mu   sync.Mutex
+	read []string
+}
+
+func (c *countingFS) ReadDir(path string) ([]os.FileInfo, error) {
+	c.mu.Lock()
+	c.read = append(c.read, path)
+	c.mu.Unlock()
+	return c.FileSystem.ReadDir(path)
+}
+
+func TestListPages(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	files := []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "h", "priv/x/y", "priv/z"}
+	for _, file := range files {
+		p := filepath.Join(d, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New()
+	fs := &countingFS{FileSystem: NewDirectory(d)}
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fs.String(), DenyPaths(allowAll(okay.New()), "/priv")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	table := []struct {
+		start string
+		size  int
+		want  []string
+	}{
+		{"", 0, []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "h"}},
+		{"", 1, []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "h"}},
+		{"", 2, []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "h"}},
+		{"", 4, []string{"a", "b/c", "b/d/e", "b/d/f", "b/g", "h"}},
+		{"b", 2, []string{"b/c", "b/d/e", "b/d/f", "b/g"}},
+		{"b/d", 1, []string{"b/d/e", "b/d/f"}},
+	}
+	for _, ent := range table {
+		fs.read = nil
+		var got []string
+		var cursor string
+		for pages := 0; ; pages++ {
+			if pages > len(files) {
+				t.Fatalf("List(%q, %d): too many pages", ent.start, ent.size)
+			}
+			page, next, err := v.List(ctx, ListOptions{Start: ent.start, PageSize: ent.size, Cursor: cursor})
+			if err != nil {
+				t.Fatalf("List(%q, %d): %v", ent.start, ent.size, err)
+			}
+			if ent.size > 0 && len(page) > ent.size {
+				t.Errorf("List(%q, %d): got page of %d", ent.start, ent.size, len(page))
+			}
+			got = append(got, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if !reflect.DeepEqual(got, ent.want) {
+			t.Errorf("List(%q, %d): got %v, want %v", ent.start, ent.size, got, ent.want)
+		}
+		for _, dir := range fs.read {
+			if strings.HasPrefix(dir, "priv") {
+				t.Errorf("List(%q, %d): read denied directory %q", ent.start, ent.size, dir)
+			}
+		}
+	}
+
+	if _, _, err := v.List(ctx, ListOptions{Start: "b", Cursor: "h"}); err == nil {
+		t.Errorf("List with a cursor outside Start: got no error")
+	}
+	if _, _, err := v.List(ctx, ListOptions{Start: "priv"}); err != ErrNoAccess {
+		t.Errorf("List(priv): got %v, want %v", err, ErrNoAccess)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := v.List(cctx, ListOptions{}); err != context.Canceled {
+		t.Errorf("List with canceled context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStatAndWalk(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, file := range []string{"pub/a", "pub/sub/b", "priv/c", "top"} {
+		p := filepath.Join(d, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New()
+	fs := NewDirectory(d)
+	if err := s.AddFileSystem(fs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOK(fs.String(), AllowSubtree(allowAll(okay.New()), "/pub")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(fs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	table := []struct {
+		path    string
+		dir     bool
+		err     error
+		conceal bool
+	}{
+		{path: "/", dir: true},
+		{path: "/pub", dir: true},
+		{path: "/pub/a"},
+		{path: "/pub/missing", conceal: true},
+		{path: "/priv", err: ErrNoAccess},
+		{path: "/priv/c", err: ErrNoAccess},
+		{path: "/priv/missing", err: ErrNoAccess},
+	}
+	for _, ent := range table {
+		fi, err := v.Stat(ctx, ent.path)
+		switch {
+		case ent.err != nil:
+			if err != ent.err {
+				t.Errorf("Stat(%q): got %v, want %v", ent.path, err, ent.err)
+			}
+		case ent.conceal:
+			if !os.IsNotExist(err) {
+				t.Errorf("Stat(%q): got %v, want not found", ent.path, err)
+			}
+		case err != nil:
+			t.Errorf("Stat(%q): %v", ent.path, err)
+		case fi.IsDir() != ent.dir:
+			t.Errorf("Stat(%q): got dir %v, want %v", ent.path, fi.IsDir(), ent.dir)
+		}
+	}
+
+	// With Conceal, denied paths look just like missing ones.
+	v.Conceal = true
+	_, missing := v.Stat(ctx, "/pub/missing")
+	for _, p := range []string{"/priv/c", "/priv/missing"} {
+		_, err := v.Stat(ctx, p)
+		if !os.IsNotExist(err) || reflect.TypeOf(err) != reflect.TypeOf(missing) {
+			t.Errorf("concealed Stat(%q): got %v, want an error like %v", p, err, missing)
+		}
+	}
+	if _, err := v.Open(ctx, "/priv/c"); !os.IsNotExist(err) {
+		t.Errorf("concealed Open: got %v, want not found", err)
+	}
+	v.Conceal = false
+
+	var got []string
+	if err := v.Walk(ctx, "/", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		got = append(got, p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"/", "/pub", "/pub/a", "/pub/sub", "/pub/sub/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk: got %v, want %v", got, want)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := v.Walk(cctx, "/", func(string, os.FileInfo, error) error { return nil }); err != context.Canceled {
+		t.Errorf("canceled Walk: got %v, want %v", err, context.Canceled)
+	}
+}
+
+// An OK written before Probes existed sees only string paths, and must still
+// be able to read the directories it grants.
+func TestStringOnlyOK(t *testing.T) {
+	m := NewMemory()
+	if err := m.MkdirAll("/pub"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/pub/a", "/priv"} {
+		w, err := m.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New()
+	if err := s.AddFileSystem(m); err != nil {
+		t.Fatal(err)
+	}
+	ok := okay.Allow(allowAll(okay.New()), func(i interface{}) (bool, error) {
+		p, ok := i.(string)
+		return ok && strings.HasPrefix(strings.TrimPrefix(p, "/"), "pub"), nil
+	})
+	if _, err := s.AddOK(m.String(), ok); err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.View(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	r, err := v.Open(ctx, "pub/a")
+	if err != nil {
+		t.Fatalf("Open(pub/a): %v", err)
+	}
+	r.Close()
+	fis, err := v.ReadDir(ctx, "pub")
+	if err != nil {
+		t.Fatalf("ReadDir(pub): %v", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "a" {
+		t.Errorf("ReadDir(pub): got %d entries, want a", len(fis))
+	}
+	files, _, err := v.List(ctx, ListOptions{Start: "pub"})
+	if err != nil {
+		t.Fatalf("List(pub): %v", err)
+	}
+	if want := []string{"pub/a"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("List(pub): got %v, want %v", files, want)
+	}
+	if _, err := v.ReadDir(ctx, "/"); err != ErrNoAccess {
+		t.Errorf("ReadDir(/): got %v, want %v", err, ErrNoAccess)
+	}
+}
+
+// Neither a Probe nor the fallback to the path for OKs that refuse Probes is
+// an access, so deciding what to show must not use up a counted grant.
+func TestProbeNotCounted(t *testing.T) {
+	m := NewMemory()
+	if err := m.MkdirAll("/pub"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := m.Create("/pub/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu   sync.Mutex
+		uses int
+	)
+	count := func() {
+		mu.Lock()
+		uses++
+		mu.Unlock()
+	}
+	table := []struct {
+		desc string
+		ok   okay.OK
+	}{
+		{
+			desc: "counting Allow",
+			ok: okay.Allow(allowAll(okay.New()), func(i interface{}) (bool, error) {
+				if _, ok := i.(string); ok {
+					count()
+				}
+				return true, nil
+			}),
+		},
+		{
+			desc: "string-only Allow counting with Accessing",
+			ok: okay.Allow(okay.Verify(okay.New(), func(ctx context.Context) (bool, error) {
+				if Accessing(ctx) {
+					count()
+				}
+				return true, nil
+			}), func(i interface{}) (bool, error) {
+				_, ok := i.(string)
+				return ok, nil
+			}),
+		},
+	}
+	for _, ent := range table {
+		uses = 0
+		s := New()
+		if err := s.AddFileSystem(m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AddOK(m.String(), ent.ok); err != nil {
+			t.Fatal(err)
+		}
+		v, err := s.View(m.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if _, err := v.Stat(ctx, "/pub/a"); err != nil {
+			t.Errorf("%s: Stat: %v", ent.desc, err)
+		}
+		if _, err := v.ReadDir(ctx, "/pub"); err != nil {
+			t.Errorf("%s: ReadDir: %v", ent.desc, err)
+		}
+		if _, _, err := v.List(ctx, ListOptions{Start: "/pub"}); err != nil {
+			t.Errorf("%s: List: %v", ent.desc, err)
+		}
+		if uses != 0 {
+			t.Errorf("%s: Stat, ReadDir and List counted %d uses, want 0", ent.desc, uses)
+		}
+		r, err := v.Open(ctx, "/pub/a")
+		if err != nil {
+			t.Fatalf("%s: Open: %v", ent.desc, err)
+		}
+		r.Close()
+		if uses != 1 {
+			t.Errorf("%s: Open counted %d uses, want 1", ent.desc, uses)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package visagetest checks that visage.FileSystem implementations keep the
+// interface's contract.
+package visagetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/kurin/visage"
+)
+
+// TestFileSystem runs a battery of tests against fs, which must be empty and
+// writable.  Each test creates files with distinct names, so the tests share
+// fs.
+func TestFileSystem(t *testing.T, fs visage.FileSystem) {
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, fs) })
+	t.Run("Traversal", func(t *testing.T) { testTraversal(t, fs) })
+	t.Run("Missing", func(t *testing.T) { testMissing(t, fs) })
+	t.Run("ReadDir", func(t *testing.T) { testReadDir(t, fs) })
+	t.Run("ReadDirOnFile", func(t *testing.T) { testReadDirOnFile(t, fs) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, fs) })
+	t.Run("LargeFile", func(t *testing.T) { testLargeFile(t, fs) })
+}
+
+func write(fs visage.FileSystem, path string, data []byte) error {
+	w, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func read(fs visage.FileSystem, path string) ([]byte, error) {
+	r, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// check reports whether path holds want.
+func check(t *testing.T, fs visage.FileSystem, path string, want []byte) {
+	t.Helper()
+	got, err := read(fs, path)
+	if err != nil {
+		t.Errorf("%s: Open(%q): %v", fs, path, err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: Open(%q): got %d bytes, want %d bytes that differ", fs, path, len(got), len(want))
+	}
+}
+
+func testRoundTrip(t *testing.T, fs visage.FileSystem) {
+	table := []struct {
+		path string
+		data string
+	}{
+		{"roundtrip", "hello, world"},
+		{"roundtrip-empty", ""},
+		{"/roundtrip-abs", "absolute"},
+	}
+	for _, ent := range table {
+		if err := write(fs, ent.path, []byte(ent.data)); err != nil {
+			t.Errorf("%s: Create(%q): %v", fs, ent.path, err)
+			continue
+		}
+		check(t, fs, ent.path, []byte(ent.data))
+		fi, err := fs.Stat(ent.path)
+		if err != nil {
+			t.Errorf("%s: Stat(%q): %v", fs, ent.path, err)
+			continue
+		}
+		if fi.IsDir() {
+			t.Errorf("%s: Stat(%q): got a directory", fs, ent.path)
+		}
+	}
+	fi, err := fs.Stat("/")
+	if err != nil {
+		t.Fatalf("%s: Stat(/): %v", fs, err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("%s: Stat(/): not a directory", fs)
+	}
+}
+
+// testTraversal checks that paths cannot reach outside the file system: ..
+// elements stop at the root, as they do in a real root directory.
+func testTraversal(t *testing.T, fs visage.FileSystem) {
+	if err := write(fs, "traversal", []byte("inside")); err != nil {
+		t.Fatalf("%s: Create(traversal): %v", fs, err)
+	}
+	for _, p := range []string{"../traversal", "/../../traversal", "a/../../traversal", `..\..\traversal`} {
+		if got, err := read(fs, p); err == nil && string(got) != "inside" {
+			t.Errorf("%s: Open(%q): got %q from outside the file system", fs, p, got)
+		}
+	}
+	for _, p := range []string{"../../../../../../etc/passwd", "/../../../../../../etc/hosts"} {
+		if _, err := fs.Open(p); err == nil {
+			t.Errorf("%s: Open(%q): opened a file outside the file system", fs, p)
+		}
+	}
+
+	// A file created above the root must end up at the root.
+	if err := write(fs, "../../traversal-created", []byte("x")); err != nil {
+		t.Errorf("%s: Create(../../traversal-created): %v", fs, err)
+		return
+	}
+	if _, err := fs.Stat("traversal-created"); err != nil {
+		t.Errorf("%s: Create(../../traversal-created): file is not at the root: %v", fs, err)
+	}
+}
+
+func testMissing(t *testing.T, fs visage.FileSystem) {
+	for _, p := range []string{"missing", "missing-dir/file"} {
+		if _, err := fs.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s: Stat(%q): got %v, want not found", fs, p, err)
+		}
+		if r, err := fs.Open(p); !os.IsNotExist(err) {
+			if err == nil {
+				r.Close()
+			}
+			t.Errorf("%s: Open(%q): got %v, want not found", fs, p, err)
+		}
+		if _, err := fs.ReadDir(p); err == nil {
+			t.Errorf("%s: ReadDir(%q): got no error", fs, p)
+		}
+	}
+}
+
+func testReadDir(t *testing.T, fs visage.FileSystem) {
+	want := []string{"readdir-a", "readdir-b", "readdir-c"}
+	for _, p := range want {
+		if err := write(fs, p, []byte(p)); err != nil {
+			t.Fatalf("%s: Create(%q): %v", fs, p, err)
+		}
+	}
+	fis, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("%s: ReadDir(/): %v", fs, err)
+	}
+	var got []string
+	for _, fi := range fis {
+		for _, w := range want {
+			if fi.Name() == w {
+				got = append(got, w)
+				if fi.IsDir() {
+					t.Errorf("%s: ReadDir(/): %s is a directory", fs, w)
+				}
+			}
+		}
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: ReadDir(/): got %v, want %v among the entries", fs, got, want)
+	}
+}
+
+func testReadDirOnFile(t *testing.T, fs visage.FileSystem) {
+	if err := write(fs, "readdir-file", []byte("not a directory")); err != nil {
+		t.Fatalf("%s: Create: %v", fs, err)
+	}
+	if fis, err := fs.ReadDir("readdir-file"); err == nil {
+		t.Errorf("%s: ReadDir of a file: got %d entries and no error", fs, len(fis))
+	}
+}
+
+func testConcurrentWriters(t *testing.T, fs visage.FileSystem) {
+	const writers = 16
+	data := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 4096+i) }
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := fs.Create(fmt.Sprintf("concurrent-%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Write in pieces, so that the writers interleave.
+			d := data(i)
+			for len(d) > 0 {
+				n := 512
+				if n > len(d) {
+					n = len(d)
+				}
+				if _, err := w.Write(d[:n]); err != nil {
+					w.Close()
+					errs <- err
+					return
+				}
+				d = d[n:]
+			}
+			if err := w.Close(); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("%s: concurrent Create: %v", fs, err)
+	}
+	for i := 0; i < writers; i++ {
+		check(t, fs, fmt.Sprintf("concurrent-%d", i), data(i))
+	}
+}
+
+func testLargeFile(t *testing.T, fs visage.FileSystem) {
+	size := 32 << 20
+	if testing.Short() {
+		size = 1 << 20
+	}
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	w, err := fs.Create("large")
+	if err != nil {
+		t.Fatalf("%s: Create(large): %v", fs, err)
+	}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		t.Fatalf("%s: Create(large): write: %v", fs, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%s: Create(large): close: %v", fs, err)
+	}
+	check(t, fs, "large", data)
+}
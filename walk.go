@@ -15,11 +15,16 @@
 package visage
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
-func walk(fs FileSystem, path string, fi os.FileInfo, fn filepath.WalkFunc) error {
+// walk walks the directory at path.  If fs is a LinkFileSystem, reals holds
+// the real paths of path and the directories above it, so that links back to
+// them are not followed.
+func walk(fs FileSystem, path string, fi os.FileInfo, fn filepath.WalkFunc, reals []string) error {
 	err := fn(path, fi, nil)
 	if err != nil {
 		if fi.IsDir() && err == filepath.SkipDir {
@@ -35,7 +40,19 @@ func walk(fs FileSystem, path string, fi os.FileInfo, fn filepath.WalkFunc) erro
 		return fn(path, fi, err)
 	}
 	for _, fi := range fis {
-		err := walk(fs, filepath.Join(path, fi.Name()), fi, fn)
+		p := filepath.Join(path, fi.Name())
+		var err error
+		switch {
+		case reals == nil:
+			err = walk(fs, p, fi, fn, nil)
+		case fi.Mode()&os.ModeSymlink != 0:
+			err = walkLink(fs.(LinkFileSystem), p, fi, fn, reals)
+		case fi.IsDir():
+			real := cleanPath(reals[len(reals)-1] + "/" + fi.Name())
+			err = walk(fs, p, fi, fn, append(reals, real))
+		default:
+			err = walk(fs, p, fi, fn, reals)
+		}
 		if err != nil {
 			if err != filepath.SkipDir || !fi.IsDir() {
 				return err
@@ -45,19 +62,246 @@ func walk(fs FileSystem, path string, fi os.FileInfo, fn filepath.WalkFunc) erro
 	return nil
 }
 
-// Walk implements filepath.Walk for the given directory in the given
-// file system, except that it does not know about symlinks because
-// FileSystem does not implement Lstat.
+// walkLink follows the symbolic link at path, whose own FileInfo is fi.
+func walkLink(fs LinkFileSystem, path string, fi os.FileInfo, fn filepath.WalkFunc, reals []string) error {
+	real, err := realPath(fs, path)
+	var dest os.FileInfo
+	if err == nil {
+		dest, err = fs.Stat(path)
+	}
+	if err != nil {
+		return fn(path, fi, err)
+	}
+	if !dest.IsDir() {
+		return fn(path, dest, nil)
+	}
+	for _, r := range reals {
+		if under(r, real) {
+			err := fn(path, dest, &os.PathError{Op: "walk", Path: path, Err: ErrLinkLoop})
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	return walk(fs, path, dest, fn, append(reals, real))
+}
+
+// Walk implements filepath.Walk for the given directory in the given file
+// system.  Unlike filepath.Walk, if fs is a LinkFileSystem, Walk follows
+// symbolic links, passing fn the FileInfo of the link's destination.  A link
+// to a directory that is already being walked is not followed; instead fn is
+// given an error wrapping ErrLinkLoop.  Links that cannot be followed are
+// passed to fn with the error, and the link's own FileInfo.
 func Walk(fs FileSystem, root string, fn filepath.WalkFunc) error {
 	fi, err := fs.Stat(root)
 	var fnErr error
 	if err != nil {
 		fnErr = fn(root, nil, err)
 	} else {
-		fnErr = walk(fs, root, fi, fn)
+		var reals []string
+		if lfs, ok := fs.(LinkFileSystem); ok {
+			real, err := realPath(lfs, root)
+			if err != nil {
+				real = cleanPath(root)
+			}
+			reals = []string{real}
+		}
+		fnErr = walk(fs, root, fi, fn, reals)
 	}
 	if fnErr == filepath.SkipDir {
 		return nil
 	}
 	return fnErr
 }
+
+// WalkOptions configure WalkConcurrent.
+type WalkOptions struct {
+	// Parallelism limits the number of concurrent ReadDir calls.  If it is
+	// not positive, DefaultParallelism is used.
+	Parallelism int
+
+	// Ordered makes WalkConcurrent visit the entries of each directory in
+	// lexical order, depth first, so that every walk of an unchanging tree
+	// is the same.  Otherwise, directories are visited as they are read.
+	Ordered bool
+}
+
+// DefaultParallelism is the number of concurrent ReadDir calls made by
+// WalkConcurrent if the options do not say.
+const DefaultParallelism = 8
+
+// WalkConcurrent is like Walk, but reads directories concurrently, which
+// helps on file systems where each ReadDir is a round trip.  fn is never
+// called concurrently, and it is always called for a directory before the
+// directory's entries, so that returning filepath.SkipDir keeps them from
+// being visited.  If ctx is canceled, WalkConcurrent stops and returns its
+// error.  Unlike Walk, WalkConcurrent does not follow symbolic links.
+func WalkConcurrent(ctx context.Context, fs FileSystem, root string, opts WalkOptions, fn filepath.WalkFunc) error {
+	n := opts.Parallelism
+	if n <= 0 {
+		n = DefaultParallelism
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{
+		ctx: ctx,
+		fs:  ToContext(fs),
+		fn:  fn,
+		sem: make(chan struct{}, n),
+	}
+
+	fi, err := w.fs.StatContext(ctx, root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = fn(root, fi, nil)
+		if err == nil && fi.IsDir() {
+			if opts.Ordered {
+				err = w.ordered(root, fi, w.read(root))
+			} else {
+				err = w.unordered(root, fi)
+			}
+		}
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	ctx context.Context
+	fs  FileSystemContext
+	fn  filepath.WalkFunc
+	sem chan struct{}
+}
+
+// listing is the result of reading a directory.
+type listing struct {
+	path string
+	fi   os.FileInfo
+	fis  []os.FileInfo
+	err  error
+	done chan struct{}
+}
+
+// read starts reading path, and returns a listing that is complete when its
+// done channel is closed.
+func (w *walker) read(path string) *listing {
+	l := &listing{path: path, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		select {
+		case w.sem <- struct{}{}:
+		case <-w.ctx.Done():
+			l.err = w.ctx.Err()
+			return
+		}
+		l.fis, l.err = w.fs.ReadDirContext(w.ctx, path)
+		<-w.sem
+	}()
+	return l
+}
+
+// ordered walks the directory at path, whose listing is l, visiting entries
+// in lexical order.  The directories among the next few entries are read
+// ahead of time.
+func (w *walker) ordered(path string, fi os.FileInfo, l *listing) error {
+	select {
+	case <-l.done:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if l.err != nil {
+		return w.fn(path, fi, l.err)
+	}
+	fis := l.fis
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+
+	ahead := make(map[int]*listing)
+	var next int
+	for i, fi := range fis {
+		for ; next < len(fis) && len(ahead) < cap(w.sem); next++ {
+			if fis[next].IsDir() {
+				ahead[next] = w.read(filepath.Join(path, fis[next].Name()))
+			}
+		}
+		sub := ahead[i]
+		delete(ahead, i)
+
+		p := filepath.Join(path, fi.Name())
+		if err := w.fn(p, fi, nil); err != nil {
+			if err == filepath.SkipDir && fi.IsDir() {
+				continue
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		if err := w.ordered(p, fi, sub); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// unordered walks the directory at root, visiting entries as their
+// directories are read.
+func (w *walker) unordered(root string, fi os.FileInfo) error {
+	results := make(chan *listing)
+	queue := []*listing{{path: root, fi: fi}}
+	var inflight int
+	for {
+		for len(queue) > 0 && inflight < cap(w.sem) {
+			l := queue[0]
+			queue = queue[1:]
+			inflight++
+			go func() {
+				l.fis, l.err = w.fs.ReadDirContext(w.ctx, l.path)
+				select {
+				case results <- l:
+				case <-w.ctx.Done():
+				}
+			}()
+		}
+		if inflight == 0 {
+			return nil
+		}
+
+		var l *listing
+		select {
+		case l = <-results:
+			inflight--
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		if l.err != nil {
+			if err := w.fn(l.path, l.fi, l.err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		for _, fi := range l.fis {
+			p := filepath.Join(l.path, fi.Name())
+			err := w.fn(p, fi, nil)
+			if err == filepath.SkipDir {
+				if fi.IsDir() {
+					continue
+				}
+				// As with Walk, skip the rest of the directory.
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				queue = append(queue, &listing{path: p, fi: fi})
+			}
+		}
+	}
+}
@@ -0,0 +1,293 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package visage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowFS is a FileSystem whose ReadDir calls take a while, and which records
+// how many are made at once.
+type slowFS struct {
+	dirs  map[string][]string // directory to its entries; entries not in dirs are files
+	delay time.Duration
+	fail  map[string]bool
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+	read      []string
+}
+
+// newSlowFS returns a tree with fanout directories at each of depth levels,
+// each holding two files.
+func newSlowFS(fanout, depth int, delay time.Duration) *slowFS {
+	fs := &slowFS{dirs: make(map[string][]string), delay: delay}
+	var build func(string, int)
+	build = func(dir string, level int) {
+		ents := []string{"f1", "f2"}
+		if level < depth {
+			for i := 0; i < fanout; i++ {
+				name := fmt.Sprintf("d%d", i)
+				ents = append(ents, name)
+				build(filepath.Join(dir, name), level+1)
+			}
+		}
+		// Return entries out of order, so that ordering must be imposed.
+		sort.Sort(sort.Reverse(sort.StringSlice(ents)))
+		fs.dirs[dir] = ents
+	}
+	build("", 0)
+	return fs
+}
+
+func (fs *slowFS) String() string                        { return "slow" }
+func (fs *slowFS) Open(string) (io.ReadCloser, error)    { return nil, os.ErrNotExist }
+func (fs *slowFS) Create(string) (io.WriteCloser, error) { return nil, os.ErrPermission }
+
+func (fs *slowFS) Stat(p string) (os.FileInfo, error) {
+	_, dir := fs.dirs[p]
+	return fileInfo{name: filepath.Base(p), dir: dir}, nil
+}
+
+func (fs *slowFS) ReadDir(p string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	fs.active++
+	if fs.active > fs.maxActive {
+		fs.maxActive = fs.active
+	}
+	fs.read = append(fs.read, p)
+	fs.mu.Unlock()
+
+	time.Sleep(fs.delay)
+
+	fs.mu.Lock()
+	fs.active--
+	fs.mu.Unlock()
+
+	if fs.fail[p] {
+		return nil, errors.New("read failed")
+	}
+	var fis []os.FileInfo
+	for _, name := range fs.dirs[p] {
+		_, dir := fs.dirs[filepath.Join(p, name)]
+		fis = append(fis, fileInfo{name: name, dir: dir})
+	}
+	return fis, nil
+}
+
+// walked returns the paths visited by a walk of fs, in order.
+func walked(t *testing.T, fs FileSystem, opts *WalkOptions, fn filepath.WalkFunc) ([]string, error) {
+	var paths []string
+	var mu sync.Mutex
+	var inFn bool
+	walkFn := func(p string, fi os.FileInfo, err error) error {
+		mu.Lock()
+		if inFn {
+			t.Errorf("fn called concurrently")
+		}
+		inFn = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFn = false
+			mu.Unlock()
+		}()
+		if err == nil {
+			paths = append(paths, p)
+		}
+		if fn != nil {
+			return fn(p, fi, err)
+		}
+		return nil
+	}
+	if opts == nil {
+		return paths, Walk(fs, "", walkFn)
+	}
+	return paths, WalkConcurrent(context.Background(), fs, "", *opts, walkFn)
+}
+
+func TestWalkConcurrent(t *testing.T) {
+	skip := func(p string, fi os.FileInfo, err error) error {
+		switch p {
+		case "d1":
+			return filepath.SkipDir
+		case filepath.Join("d2", "f1"):
+			// Skips the rest of d2.
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	table := []struct {
+		desc string
+		fn   filepath.WalkFunc
+	}{
+		{desc: "everything"},
+		{desc: "skip", fn: skip},
+	}
+
+	for _, ent := range table {
+		for _, ordered := range []bool{false, true} {
+			fs := newSlowFS(3, 2, time.Millisecond)
+			if ordered {
+				// An ordered walk should match Walk over sorted entries.
+				for _, ents := range fs.dirs {
+					sort.Strings(ents)
+				}
+			}
+			want, err := walked(t, fs, nil, ent.fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fs = newSlowFS(3, 2, time.Millisecond)
+			got, err := walked(t, fs, &WalkOptions{Parallelism: 2, Ordered: ordered}, ent.fn)
+			if err != nil {
+				t.Errorf("%s, ordered %v: %v", ent.desc, ordered, err)
+				continue
+			}
+			if fs.maxActive > 2 {
+				t.Errorf("%s, ordered %v: %d concurrent reads, want at most 2", ent.desc, ordered, fs.maxActive)
+			}
+			if !ordered {
+				sort.Strings(got)
+				sort.Strings(want)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, ordered %v: got %v, want %v", ent.desc, ordered, got, want)
+			}
+			if ent.fn != nil && !ordered {
+				for _, p := range fs.read {
+					if p == "d1" || filepath.Dir(p) == "d1" {
+						t.Errorf("%s: read skipped directory %q", ent.desc, p)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWalkConcurrentIsParallel(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		fs := newSlowFS(8, 1, 20*time.Millisecond)
+		start := time.Now()
+		if _, err := walked(t, fs, &WalkOptions{Parallelism: 8, Ordered: ordered}, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Nine directories read one at a time would take 180ms.
+		if d := time.Since(start); d > 150*time.Millisecond {
+			t.Errorf("ordered %v: walk took %v", ordered, d)
+		}
+		if fs.maxActive < 2 {
+			t.Errorf("ordered %v: reads were not concurrent", ordered)
+		}
+	}
+}
+
+func TestWalkConcurrentErrors(t *testing.T) {
+	stop := errors.New("stop")
+	for _, ordered := range []bool{false, true} {
+		opts := WalkOptions{Parallelism: 4, Ordered: ordered}
+
+		fs := newSlowFS(3, 2, time.Millisecond)
+		fs.fail = map[string]bool{"d0": true}
+		var failed []string
+		_, err := walked(t, fs, &opts, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				failed = append(failed, p)
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(failed, []string{"d0"}) {
+			t.Errorf("ordered %v: read error: got %v, %v; want d0 reported and skipped", ordered, failed, err)
+		}
+
+		fs = newSlowFS(3, 2, time.Millisecond)
+		_, err = walked(t, fs, &opts, func(p string, fi os.FileInfo, err error) error {
+			if p == filepath.Join("d1", "d1") {
+				return stop
+			}
+			return nil
+		})
+		if err != stop {
+			t.Errorf("ordered %v: got %v, want %v", ordered, err, stop)
+		}
+
+		fs = newSlowFS(3, 3, 5*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int
+		err = WalkConcurrent(ctx, fs, "", opts, func(p string, fi os.FileInfo, err error) error {
+			calls++
+			if calls == 5 {
+				cancel()
+			}
+			return nil
+		})
+		if err != context.Canceled {
+			t.Errorf("ordered %v: canceled walk: got %v, want %v", ordered, err, context.Canceled)
+		}
+	}
+}
+
+func TestWalkLinks(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	fs := NewDirectory(linkTree(t, d))
+
+	var got []string
+	errs := make(map[string]error)
+	err = Walk(fs, "/", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			errs[p] = err
+			return nil
+		}
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{"/", "/a", "/abs", "/abs/b", "/in", "/in/b", "/sub", "/sub/b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk: got %v, want %v", got, want)
+	}
+	for _, p := range []string{"/abs/loop", "/in/loop", "/sub/loop"} {
+		if pe, ok := errs[p].(*os.PathError); !ok || pe.Err != ErrLinkLoop {
+			t.Errorf("Walk: %s: got %v, want %v", p, errs[p], ErrLinkLoop)
+		}
+	}
+	for _, p := range []string{"/out", "/dangling"} {
+		if errs[p] == nil {
+			t.Errorf("Walk: %s: got no error", p)
+		}
+	}
+}
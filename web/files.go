@@ -0,0 +1,193 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/kurin/visage"
+)
+
+type crumb struct {
+	Name string
+	Path string
+}
+
+type entry struct {
+	Name    string
+	Path    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+type listing struct {
+	FileSystem string
+	Dir        string
+	Crumbs     []crumb
+	Entries    []entry
+	Token      string
+}
+
+// crumbs returns the breadcrumb trail for dir, starting at the root.
+func crumbs(dir string) []crumb {
+	cs := []crumb{{Name: "/", Path: "/"}}
+	dir = path.Clean("/" + dir)
+	if dir == "/" {
+		return cs
+	}
+	var p string
+	for _, name := range splitPath(dir) {
+		p = path.Join(p, name)
+		cs = append(cs, crumb{Name: name, Path: "/" + p})
+	}
+	return cs
+}
+
+func splitPath(p string) []string {
+	var parts []string
+	for p != "/" && p != "." && p != "" {
+		dir, file := path.Split(p)
+		parts = append([]string{file}, parts...)
+		p = path.Clean(dir)
+	}
+	return parts
+}
+
+// fileError writes an appropriate response for an error returned by a View.
+func fileError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == visage.ErrNoAccess:
+		http.Error(w, "403 "+err.Error(), http.StatusForbidden)
+	case err == visage.ErrRemoved, os.IsNotExist(err):
+		http.Error(w, "404 not found", http.StatusNotFound)
+	default:
+		internalError(w, r, err)
+	}
+}
+
+// view returns a View of the named file system, configured for the server.
+func (s *Server) view(fs string) (*visage.View, error) {
+	v, err := s.Visage.View(fs)
+	if err != nil {
+		return nil, err
+	}
+	v.Conceal = s.Conceal
+	return v, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	ctx := s.Context(r)
+	q := r.URL.Query()
+	fs := q.Get("fs")
+	dir := path.Clean("/" + q.Get("dir"))
+	v, err := s.view(fs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fis, err := v.ReadDir(ctx, dir)
+	if err != nil {
+		fileError(w, r, err)
+		return
+	}
+	l := listing{
+		FileSystem: fs,
+		Dir:        dir,
+		Crumbs:     crumbs(dir),
+		Token:      q.Get("t"),
+	}
+	for _, fi := range fis {
+		l.Entries = append(l.Entries, entry{
+			Name:    fi.Name(),
+			Path:    path.Join(dir, fi.Name()),
+			Dir:     fi.IsDir(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	sort.Slice(l.Entries, func(i, j int) bool {
+		if l.Entries[i].Dir != l.Entries[j].Dir {
+			return l.Entries[i].Dir
+		}
+		return l.Entries[i].Name < l.Entries[j].Name
+	})
+	s.servePage(w, r, "list.html", l)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	ctx := s.Context(r)
+	q := r.URL.Query()
+	file := q.Get("file")
+	fs := q.Get("fs")
+	v, err := s.view(fs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fi, err := v.Stat(ctx, file)
+	if err != nil {
+		fileError(w, r, err)
+		return
+	}
+	if fi.IsDir() {
+		v := url.Values{"fs": {fs}, "dir": {file}}
+		// Keep a signed link's token, which may grant the directory.
+		if t := q.Get("t"); t != "" {
+			v.Set("t", t)
+		}
+		u := url.URL{Path: s.url("/list"), RawQuery: v.Encode()}
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+		return
+	}
+	f, err := v.Open(ctx, file)
+	if err != nil {
+		fileError(w, r, err)
+		return
+	}
+	defer f.Close()
+	mtime := fi.ModTime()
+
+	name := path.Base(file)
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, mtime, rs)
+		return
+	}
+
+	// Without a seeker there is no way to serve ranges, so send the whole
+	// file and say as much.
+	br := bufio.NewReader(f)
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		head, _ := br.Peek(512)
+		ctype = http.DetectContentType(head)
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if !mtime.IsZero() {
+		w.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	}
+	io.Copy(w, br)
+}
@@ -0,0 +1,206 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+	"github.com/kurin/visage"
+	"github.com/kurin/visage/token"
+)
+
+func TestCrumbs(t *testing.T) {
+	table := []struct {
+		dir  string
+		want []crumb
+	}{
+		{
+			dir:  "",
+			want: []crumb{{"/", "/"}},
+		},
+		{
+			dir:  "/a/b/",
+			want: []crumb{{"/", "/"}, {"a", "/a"}, {"b", "/a/b"}},
+		},
+		{
+			dir:  "../a",
+			want: []crumb{{"/", "/"}, {"a", "/a"}},
+		},
+	}
+	for _, ent := range table {
+		if got := crumbs(ent.dir); !reflect.DeepEqual(got, ent.want) {
+			t.Errorf("crumbs(%q): got %v, want %v", ent.dir, got, ent.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "hello.txt"), []byte("hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Visage: visage.New()}
+	if err := s.Visage.AddFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	ok := okay.Verify(okay.New(), func(context.Context) (bool, error) { return true, nil })
+	ok = okay.Allow(ok, func(p interface{}) (bool, error) { return p == "hello.txt", nil })
+	if _, err := s.Visage.AddOK(d, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(file, rng string) *httptest.ResponseRecorder {
+		v := url.Values{"fs": {d}, "file": {file}}
+		r := httptest.NewRequest("GET", "/get?"+v.Encode(), nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		s.get(w, r)
+		return w
+	}
+
+	w := get("hello.txt", "")
+	if w.Code != http.StatusOK || w.Body.String() != "hello, world" {
+		t.Errorf("get: got %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("get: Content-Type: got %q", ct)
+	}
+	if w.Header().Get("Last-Modified") == "" {
+		t.Errorf("get: no Last-Modified header")
+	}
+
+	w = get("hello.txt", "bytes=7-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("get with range: got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := get("secret", ""); w.Code != http.StatusForbidden {
+		t.Errorf("get secret: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	s.Conceal = true
+	for _, file := range []string{"secret", "missing"} {
+		if w := get(file, ""); w.Code != http.StatusNotFound {
+			t.Errorf("get %s with Conceal: got %d, want %d", file, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetSignedLink(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "once.txt"), []byte("once"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Visage: visage.New(), LinkKey: []byte("secret")}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := token.Sign(s.LinkKey, token.Claim{FileSystem: d, Path: "once.txt", Expires: time.Now().Add(time.Hour), MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := "/get?" + url.Values{"fs": {d}, "file": {"once.txt"}, "t": {tok}}.Encode()
+
+	table := []struct {
+		code int
+		body string
+	}{
+		{code: http.StatusOK, body: "once"},
+		{code: http.StatusForbidden},
+	}
+	for i, ent := range table {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != ent.code {
+			t.Errorf("use %d: got %d, want %d", i+1, w.Code, ent.code)
+			continue
+		}
+		if ent.body != "" && w.Body.String() != ent.body {
+			t.Errorf("use %d: got %q, want %q", i+1, w.Body.String(), ent.body)
+		}
+	}
+}
+
+func TestGetSignedDirectoryLink(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := os.Mkdir(filepath.Join(d, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Visage: visage.New(), LinkKey: []byte("secret")}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := token.Sign(s.LinkKey, token.Claim{FileSystem: d, Path: "sub", Prefix: true, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/get?"+url.Values{"fs": {d}, "file": {"sub"}, "t": {tok}}.Encode(), nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("get sub: got %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	loc := w.Header().Get("Location")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", loc, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("following %s: got %d, want %d", loc, w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("following %s: listing does not show a.txt:\n%s", loc, w.Body.String())
+	}
+}
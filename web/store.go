@@ -0,0 +1,248 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kurin/visage"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A Store persists the server's State between restarts.
+type Store interface {
+	// Load returns the most recently saved State.  If nothing has been saved,
+	// Load should return an empty State and no error.
+	Load() (*State, error)
+
+	// Save replaces any previously saved State.
+	Save(*State) error
+}
+
+// NewFileStore returns a Store that keeps State as JSON in the named file.
+func NewFileStore(path string) Store { return fileStore(path) }
+
+type fileStore string
+
+func (f fileStore) Load() (*State, error) {
+	st := &State{}
+	b, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("web: %s: %v", string(f), err)
+	}
+	return st, nil
+}
+
+func (f fileStore) Save(st *State) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(string(f)), filepath.Base(string(f)))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), string(f))
+}
+
+var (
+	sharesBucket = []byte("shares")
+	adminsBucket = []byte("admins")
+)
+
+// BoltStore is a Store backed by a local bbolt database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the bolt database at the given path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (b *BoltStore) Close() error { return b.db.Close() }
+
+func (b *BoltStore) Load() (*State, error) {
+	st := &State{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket(sharesBucket); bk != nil {
+			if err := bk.ForEach(func(k, v []byte) error {
+				var sh Share
+				if err := json.Unmarshal(v, &sh); err != nil {
+					return fmt.Errorf("web: share %s: %v", k, err)
+				}
+				st.Shares = append(st.Shares, sh)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if bk := tx.Bucket(adminsBucket); bk != nil {
+			if err := bk.ForEach(func(k, v []byte) error {
+				var g Grant
+				if err := json.Unmarshal(v, &g); err != nil {
+					return fmt.Errorf("web: admin %s: %v", k, err)
+				}
+				st.Admins = append(st.Admins, g)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (b *BoltStore) Save(st *State) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sharesBucket, adminsBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		shares, err := tx.CreateBucket(sharesBucket)
+		if err != nil {
+			return err
+		}
+		for i, sh := range st.Shares {
+			v, err := json.Marshal(sh)
+			if err != nil {
+				return err
+			}
+			// Keys are zero-padded so that ForEach returns shares in order.
+			if err := shares.Put([]byte(fmt.Sprintf("%08d", i)), v); err != nil {
+				return err
+			}
+		}
+		admins, err := tx.CreateBucket(adminsBucket)
+		if err != nil {
+			return err
+		}
+		for i, g := range st.Admins {
+			v, err := json.Marshal(g)
+			if err != nil {
+				return err
+			}
+			if err := admins.Put([]byte(fmt.Sprintf("%08d", i)), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expired reports whether the grant has a deadline that has passed.
+func (g Grant) expired(now time.Time) bool {
+	return !g.Expires.IsZero() && !now.Before(g.Expires)
+}
+
+// restore loads the saved State and replays it into the server's visage.Share.
+// Grants that have expired are dropped.
+func (s *Server) restore() error {
+	st := &State{}
+	if s.Store != nil {
+		var err error
+		st, err = s.Store.Load()
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var admins []Grant
+	for _, g := range st.Admins {
+		if g.expired(now) {
+			continue
+		}
+		ok, _ := g.Make(s.registry)
+		s.admins = append(s.admins, ok)
+		admins = append(admins, g)
+	}
+	st.Admins = admins
+
+	for i := range st.Shares {
+		sh := &st.Shares[i]
+		if err := s.restoreFileSystem(sh); err != nil {
+			return err
+		}
+		var grants []Grant
+		for _, g := range sh.Grants {
+			if g.expired(now) {
+				continue
+			}
+			if err := s.grant(sh.FileSystem, &g); err != nil {
+				return err
+			}
+			grants = append(grants, g)
+		}
+		sh.Grants = grants
+	}
+	s.State = st
+	return nil
+}
+
+// restoreFileSystem registers the file system of a saved share.  A file
+// system the program has already registered under the share's name is kept
+// as it is; otherwise only directories can be rebuilt from the saved State.
+func (s *Server) restoreFileSystem(sh *Share) error {
+	if _, err := s.Visage.FileSystem(sh.FileSystem); err == nil {
+		return s.allowLinks(sh.FileSystem)
+	}
+	switch sh.Kind {
+	case "", KindDirectory:
+		return s.addFileSystem(visage.NewDirectory(sh.FileSystem))
+	}
+	return fmt.Errorf("web: share %s: cannot restore a %q file system; register it before starting the server", sh.FileSystem, sh.Kind)
+}
+
+// save writes the current State to the Store, if there is one.  The caller
+// must hold s.mu.
+func (s *Server) save() error {
+	if s.Store == nil {
+		return nil
+	}
+	return s.Store.Save(s.State)
+}
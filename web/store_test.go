@@ -0,0 +1,201 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kurin/visage"
+)
+
+func testState() *State {
+	return &State{
+		Shares: []Share{
+			{
+				FileSystem: "/tmp/a",
+				Name:       "a",
+				Grants: []Grant{
+					{Provider: "google", Values: []string{"a@example.com"}},
+					{Provider: "github", Values: []string{"b"}, Write: true},
+				},
+			},
+			{
+				FileSystem: "/tmp/b",
+				Name:       "b",
+			},
+		},
+		Admins: []Grant{
+			{Provider: "github", Values: []string{"admin"}},
+		},
+	}
+}
+
+func TestStores(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	bs, err := NewBoltStore(filepath.Join(d, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	table := []struct {
+		desc  string
+		store Store
+	}{
+		{
+			desc:  "file",
+			store: NewFileStore(filepath.Join(d, "state.json")),
+		},
+		{
+			desc:  "bolt",
+			store: bs,
+		},
+	}
+
+	for _, ent := range table {
+		st, err := ent.store.Load()
+		if err != nil {
+			t.Errorf("%s: Load (empty): %v", ent.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(st, &State{}) {
+			t.Errorf("%s: Load (empty): got %#v, want empty State", ent.desc, st)
+		}
+		want := testState()
+		if err := ent.store.Save(want); err != nil {
+			t.Errorf("%s: Save: %v", ent.desc, err)
+			continue
+		}
+		got, err := ent.store.Load()
+		if err != nil {
+			t.Errorf("%s: Load: %v", ent.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Load: got %#v, want %#v", ent.desc, got, want)
+		}
+	}
+}
+
+func TestRestoreDropsExpired(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	st := testState()
+	st.Shares[0].Grants[0].Expires = time.Now().Add(-time.Hour)
+	st.Admins[0].Expires = time.Now().Add(-time.Hour)
+	store := NewFileStore(filepath.Join(d, "state.json"))
+	if err := store.Save(st); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Visage: visage.New(),
+		Store:  store,
+	}
+	if err := s.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Visage.FileSystems(), []string{"/tmp/a", "/tmp/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FileSystems: got %v, want %v", got, want)
+	}
+	if n := len(s.State.Shares[0].Grants); n != 1 {
+		t.Errorf("grants after restore: got %d, want 1", n)
+	}
+	if n := len(s.State.Admins); n != 0 {
+		t.Errorf("admins after restore: got %d, want 0", n)
+	}
+}
+
+func TestRestoreKinds(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	m := visage.NewMemory()
+	table := []struct {
+		desc  string
+		share Share
+		pre   visage.FileSystem
+		want  visage.FileSystem
+		err   bool
+	}{
+		{
+			desc:  "directory",
+			share: Share{FileSystem: d, Kind: KindDirectory},
+			want:  visage.NewDirectory(d),
+		},
+		{
+			desc:  "saved without a kind",
+			share: Share{FileSystem: d},
+			want:  visage.NewDirectory(d),
+		},
+		{
+			desc:  "registered by the program",
+			share: Share{FileSystem: m.String(), Kind: "memory"},
+			pre:   m,
+			want:  m,
+		},
+		{
+			desc:  "not registered",
+			share: Share{FileSystem: "/encrypted", Kind: "encrypted"},
+			err:   true,
+		},
+	}
+
+	for _, ent := range table {
+		store := NewFileStore(filepath.Join(d, "state.json"))
+		if err := store.Save(&State{Shares: []Share{ent.share}}); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{Visage: visage.New(), Store: store}
+		if ent.pre != nil {
+			if err := s.Visage.AddFileSystem(ent.pre); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := s.restore()
+		if got := err != nil; got != ent.err {
+			t.Errorf("%s: restore: got %v, want error %v", ent.desc, err, ent.err)
+			continue
+		}
+		if ent.err {
+			continue
+		}
+		fs, err := s.Visage.FileSystem(ent.share.FileSystem)
+		if err != nil {
+			t.Errorf("%s: %v", ent.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(fs, ent.want) {
+			t.Errorf("%s: got file system %#v, want %#v", ent.desc, fs, ent.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed static/*.html
+var static embed.FS
+
+// parseTemplates parses the built-in templates, followed by any templates in
+// s.TemplateDir.  A template in TemplateDir replaces the built-in template of
+// the same name, so a theme need only provide the files it changes.
+func (s *Server) parseTemplates() (*template.Template, error) {
+	temp, err := template.New("null").Funcs(template.FuncMap{
+		"lower":   strings.ToLower,
+		"id":      mkid,
+		"url":     s.url,
+		"isAdmin": func() bool { return false },
+	}).ParseFS(static, "static/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if s.TemplateDir == "" {
+		return temp, nil
+	}
+	names, err := filepath.Glob(filepath.Join(s.TemplateDir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("web: %s: no templates found", s.TemplateDir)
+	}
+	return temp.ParseFiles(names...)
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request, name string, dot interface{}) {
+	ctx := s.Context(r)
+	temp, err := s.template.Clone()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	temp = temp.Funcs(template.FuncMap{
+		"isAdmin": func() bool { return s.isAdmin(ctx) },
+	})
+	// Render into a buffer so that a failing template doesn't leave a
+	// half-written page behind.
+	buf := &bytes.Buffer{}
+	if err := temp.ExecuteTemplate(buf, name, dot); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
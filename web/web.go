@@ -29,52 +29,102 @@ import (
 	"net/http"
 	"net/url"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/okay"
 	"github.com/kurin/visage"
-	"github.com/kurin/visage/oauth2/github"
-	"github.com/kurin/visage/oauth2/google"
+	"github.com/kurin/visage/provider"
+	"github.com/kurin/visage/token"
 )
 
 type Server struct {
 	Visage *visage.Share
 
-	Google *google.Config
-	GitHub *github.Config
+	// Providers are the identity providers users can sign in with.  Grants
+	// name them by their Name.
+	Providers []provider.Provider
 
 	State *State
 	Admin okay.OK
 
+	// Store, if set, persists State across restarts.
+	Store Store
+
+	// TemplateDir, if set, names a directory of templates that override the
+	// built-in ones.
+	TemplateDir string
+
+	// LinkKey, if set, is used to sign and verify share links, which grant
+	// access to anyone who holds them.
+	LinkKey []byte
+
+	// Conceal, if set, answers requests for files a user cannot access as
+	// though the files did not exist.
+	Conceal bool
+
+	root     string
 	template *template.Template
+	admins   []okay.OK
+	cancels  map[visage.OKID]okay.CancelFunc
+	links    okay.OK
+	registry *provider.Registry
+	mu       sync.Mutex
 }
 
-func (s *Server) RegisterHandlers(root string) error {
-	if s.Google != nil {
-		s.Google.RegisterHandlers(path.Join("/", root, "/google.login"))
-	}
-	if s.GitHub != nil {
-		s.GitHub.RegisterHandlers(path.Join("/", root, "/github.login"))
+// RegisterHandlers registers the web UI's handlers on mux, with every route
+// under the given root path.
+func (s *Server) RegisterHandlers(mux *http.ServeMux, root string) error {
+	s.root = path.Join("/", root)
+	s.registry = provider.NewRegistry(s.Providers...)
+	for _, p := range s.Providers {
+		if err := p.RegisterHandlers(mux, s.loginPath(p), s.url("/")); err != nil {
+			return err
+		}
 	}
-	// TODO: accept a custom mux
-	http.HandleFunc(path.Join("/", root, "/"), s.root)
-	//http.HandleFunc(path.Join("/", root, "/list"), s.list)
-	//http.HandleFunc(path.Join("/", root, "/get"), s.get)
-	http.HandleFunc(path.Join("/", root, "/setfs"), s.setFS)
+	s.handle(mux, s.url("/"), s.index)
+	s.handle(mux, s.url("/list"), s.list)
+	s.handle(mux, s.url("/get"), s.get)
+	s.handle(mux, s.url("/setfs"), s.setFS)
+	s.handle(mux, s.url("/rmfs"), s.removeFS)
+	s.handle(mux, s.url("/setshare"), s.setShare)
+	s.handle(mux, s.url("/revoke"), s.revoke)
+	s.handle(mux, s.url("/upload"), s.upload)
+	s.handle(mux, s.url("/link"), s.link)
 
-	temp, err := template.New("null").Funcs(template.FuncMap{
-		"lower":   strings.ToLower,
-		"id":      mkid,
-		"isAdmin": func() bool { return false },
-	}).ParseGlob("web/static/*")
+	temp, err := s.parseTemplates()
 	if err != nil {
 		return err
 	}
 	s.template = temp
-	s.State = &State{}
-	return nil
+	if s.LinkKey != nil {
+		s.links = token.VerifiesSigned(okay.New(), s.LinkKey)
+	}
+	return s.restore()
+}
+
+// handle registers h on mux under the given pattern.  The request's context
+// carries the response writer, so that providers can renew session cookies.
+func (s *Server) handle(mux *http.ServeMux, pattern string, h http.HandlerFunc) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(provider.WithResponseWriter(r.Context(), w)))
+	})
+}
+
+func (s *Server) loginPath(p provider.Provider) string {
+	return s.url("/" + p.Name() + ".login")
+}
+
+// url returns the given path beneath the server's root.  A trailing slash is
+// kept, so that url("/") is the root directory, as the index is registered.
+func (s *Server) url(p string) string {
+	u := path.Join(s.root, p)
+	if strings.HasSuffix(p, "/") && u != "/" {
+		u += "/"
+	}
+	return u
 }
 
 func mkid(s string) string {
@@ -104,149 +154,397 @@ type page struct {
 	State *State
 }
 
-func (s *Server) servePage(w http.ResponseWriter, r *http.Request, name string, dot interface{}) {
-	ctx := s.Context(r)
-	temp, err := s.template.Clone()
-	if err != nil {
-		panic(err)
-	}
-	temp = temp.Funcs(template.FuncMap{
-		"isAdmin": func() bool { y, _ := s.Admin.Verify(ctx); return y },
-	})
-	if err := temp.ExecuteTemplate(w, name, dot); err != nil {
-		panic(err)
-	}
-}
-
 func (s *Server) page(r *http.Request) page {
 	p := page{
 		State: s.State,
 	}
 	ctx := s.Context(r)
-	if s.Google != nil {
+	for _, pr := range s.Providers {
 		a := auth{
-			Path: "/google.login",
-			Name: "Google",
+			Path:   s.loginPath(pr),
+			Name:   pr.Title(),
+			Logout: pr.LogoutURL(),
 		}
-		a.Credential, a.Logged = google.Show(ctx)
-		a.Logout = s.Google.LogoutPath
+		a.Credential, a.Logged = pr.Show(ctx)
 		p.Auths = append(p.Auths, a)
 	}
-	if s.GitHub != nil {
-		a := auth{
-			Path: "/github.login",
-			Name: "GitHub",
+	return p
+}
+
+func (s *Server) isAdmin(ctx context.Context) bool {
+	if s.Admin != nil {
+		if ok, _ := s.Admin.Verify(ctx); ok {
+			return true
 		}
-		a.Credential, a.Logged = github.Show(ctx)
-		a.Logout = s.GitHub.LogoutPath
-		p.Auths = append(p.Auths, a)
 	}
-	return p
+	s.mu.Lock()
+	admins := s.admins
+	s.mu.Unlock()
+	for _, a := range admins {
+		if ok, _ := okay.Check(ctx, nil, a); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	// The index's pattern matches everything beneath the root.
+	if r.URL.Path != s.url("/") {
+		http.NotFound(w, r)
+		return
+	}
 	p := s.page(r)
 	s.servePage(w, r, "visage.html", p)
 }
 
 func (s *Server) Context(r *http.Request) context.Context {
 	ctx := r.Context()
-	switch {
-	case s.Google != nil:
-		ctx = google.Context(ctx, r)
-		fallthrough
-	case s.GitHub != nil:
-		ctx = github.Context(ctx, r)
-		fallthrough
-	default:
+	for _, p := range s.Providers {
+		ctx = p.Context(ctx, r)
+	}
+	if t := r.URL.Query().Get("t"); t != "" && s.LinkKey != nil {
+		ctx = token.SignedContext(ctx, t)
 	}
 	return ctx
 }
 
-func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+func (s *Server) setShare(w http.ResponseWriter, r *http.Request) {
 	ctx := s.Context(r)
-	file, err := url.QueryUnescape(r.URL.Query().Get("file"))
-	if err != nil {
+	if !s.isAdmin(ctx) {
+		http.Error(w, "you're not an admin", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
 		internalError(w, r, err)
 		return
 	}
-	fs, err := url.QueryUnescape(r.URL.Query().Get("fs"))
+	gstr := r.PostFormValue("grant")
+	gr, err := ParseGrant(s.registry, gstr)
 	if err != nil {
 		internalError(w, r, err)
 		return
 	}
-	fsys, err := s.Visage.View(fs)
-	if err != nil {
+	gr.AllowFiles = append(gr.AllowFiles, r.Form["files"]...)
+	if r.PostFormValue("mode") == "write" {
+		gr.Write = true
+	}
+	fs := r.PostFormValue("fs")
+	s.mu.Lock()
+	sh := s.share(fs)
+	if sh == nil {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("%s: no such share", fs), http.StatusNotFound)
+		return
+	}
+	if err := s.grant(fs, &gr); err != nil {
+		s.mu.Unlock()
 		internalError(w, r, err)
 		return
 	}
-	f, err := fsys.Open(ctx, file)
+	sh.Grants = append(sh.Grants, gr)
+	err = s.save()
+	s.mu.Unlock()
 	if err != nil {
 		internalError(w, r, err)
 		return
 	}
-	defer f.Close()
-	if rs, ok := f.(io.ReadSeeker); ok {
-		http.ServeContent(w, r, "", time.Time{}, rs)
-		return
+	http.Redirect(w, r, s.url("/"), http.StatusSeeOther)
+}
+
+// share returns the share for the given file system.  The caller must hold
+// s.mu.
+func (s *Server) share(fs string) *Share {
+	for i := range s.State.Shares {
+		if s.State.Shares[i].FileSystem == fs {
+			return &s.State.Shares[i]
+		}
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(file)))
-	io.Copy(w, f)
+	return nil
 }
 
-func (s *Server) setShare(w http.ResponseWriter, r *http.Request) {
+// findGrant returns the share holding the grant with the given ID, and the
+// grant's index in it, or nil if no share does.  The caller must hold s.mu.
+func (s *Server) findGrant(id visage.OKID) (*Share, int) {
+	for i := range s.State.Shares {
+		for j, g := range s.State.Shares[i].Grants {
+			if g.ID == id {
+				return &s.State.Shares[i], j
+			}
+		}
+	}
+	return nil, 0
+}
+
+// grant registers g with the visage.Share, and records its ID so that it can
+// be revoked later.  The caller must hold s.mu.
+func (s *Server) grant(fs string, g *Grant) error {
+	ok, cancel := g.Make(s.registry)
+	add := s.Visage.AddOK
+	if g.Write {
+		add = s.Visage.AddWriteOK
+	}
+	id, err := add(fs, ok)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if s.cancels == nil {
+		s.cancels = make(map[visage.OKID]okay.CancelFunc)
+	}
+	s.cancels[id] = cancel
+	g.ID = id
+	return nil
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
 	ctx := s.Context(r)
-	if ok, _ := s.Admin.Verify(ctx); !ok {
+	if !s.isAdmin(ctx) {
 		http.Error(w, "you're not an admin", http.StatusUnauthorized)
 		return
 	}
-	if err := r.ParseForm(); err != nil {
+	id, err := strconv.ParseUint(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Look for the grant by its ID alone, so that a stale form cannot leave
+	// it in place.
+	sh, i := s.findGrant(visage.OKID(id))
+	if sh == nil {
+		http.Error(w, fmt.Sprintf("%d: no such grant", id), http.StatusNotFound)
+		return
+	}
+	if err := s.Visage.RevokeOK(visage.OKID(id)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if cancel, ok := s.cancels[visage.OKID(id)]; ok {
+		cancel()
+		delete(s.cancels, visage.OKID(id))
+	}
+	sh.Grants = append(sh.Grants[:i], sh.Grants[i+1:]...)
+	if err := s.save(); err != nil {
 		internalError(w, r, err)
 		return
 	}
-	gstr := r.PostFormValue("grant")
-	gr, err := ParseGrant(gstr)
+	http.Redirect(w, r, s.url("/"), http.StatusSeeOther)
+}
+
+// uploadPage is the page that uploads files to a directory.  It needs no read
+// access, so that write-only grants can be used as drop boxes.
+type uploadPage struct {
+	FileSystem string
+	Dir        string
+	Uploaded   string
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	ctx := s.Context(r)
+	fs := r.FormValue("fs")
+	dir := path.Clean("/" + r.FormValue("dir"))
+	v, err := s.view(fs)
 	if err != nil {
-		internalError(w, r, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	ok, _ := gr.Make()
-	fs := r.PostFormValue("fs")
-	if len(r.Form["files"]) > 0 {
-		allowed := make(map[string]bool)
-		for _, file := range r.Form["files"] {
-			allowed[file] = true
-		}
-		ok = okay.Allow(ok, func(p interface{}) (bool, error) {
-			path, k := p.(string)
-			if !k {
-				return false, nil
-			}
-			return allowed[path], nil
+	switch r.Method {
+	case http.MethodGet:
+		s.servePage(w, r, "upload.html", uploadPage{
+			FileSystem: fs,
+			Dir:        dir,
+			Uploaded:   r.FormValue("uploaded"),
 		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	base := path.Base(hdr.Filename)
+	if base == "." || base == ".." || base == "/" {
+		http.Error(w, "no file name given", http.StatusBadRequest)
+		return
+	}
+	name := path.Join(dir, base)
+	wc, err := v.Create(ctx, name)
+	if err != nil {
+		fileError(w, r, err)
+		return
+	}
+	if _, err := io.Copy(wc, f); err != nil {
+		wc.Close()
+		internalError(w, r, err)
+		return
+	}
+	if err := wc.Close(); err != nil {
+		internalError(w, r, err)
+		return
 	}
-	s.Visage.AddOK(fs, ok)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Send those who can read the directory back to it, and everyone else
+	// back to the upload page.
+	q := url.Values{"fs": {fs}, "dir": {dir}}
+	u := url.URL{Path: s.url("/list")}
+	if _, err := v.Stat(ctx, dir); err != nil {
+		q.Set("uploaded", base)
+		u.Path = s.url("/upload")
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
 }
 
 func (s *Server) setFS(w http.ResponseWriter, r *http.Request) {
 	ctx := s.Context(r)
-	if ok, _ := s.Admin.Verify(ctx); !ok {
+	if !s.isAdmin(ctx) {
 		http.Error(w, "you're not an admin", http.StatusUnauthorized)
 		return
 	}
 	fs := r.PostFormValue("fs")
-	fsys := visage.NewDirectory(fs)
-	if err := s.Visage.AddFileSystem(fsys); err != nil {
+	if err := s.addFileSystem(visage.NewDirectory(fs)); err != nil {
 		internalError(w, r, err)
 		return
 	}
+	s.mu.Lock()
 	s.State.Shares = append(s.State.Shares, Share{
 		FileSystem: fs,
 		Name:       fs,
+		Kind:       KindDirectory,
 	})
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	err := s.save()
+	s.mu.Unlock()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, s.url("/"), http.StatusSeeOther)
+}
+
+// addFileSystem registers fsys with the server's visage.Share, and allows
+// signed links to be used with it.
+func (s *Server) addFileSystem(fsys visage.FileSystem) error {
+	if err := s.Visage.AddFileSystem(fsys); err != nil {
+		return err
+	}
+	return s.allowLinks(fsys.String())
+}
+
+// allowLinks allows signed links to be used with the named file system.
+func (s *Server) allowLinks(fs string) error {
+	if s.links == nil {
+		return nil
+	}
+	_, err := s.Visage.AddOK(fs, s.links)
+	return err
+}
+
+// defaultLinkTTL is how long a share link lasts when no ttl is given.  Links
+// cannot be revoked, so every link expires.
+const defaultLinkTTL = 7 * 24 * time.Hour
+
+// link responds with a signed URL that grants access to a file, or with
+// prefix set, to everything under a directory.
+func (s *Server) link(w http.ResponseWriter, r *http.Request) {
+	ctx := s.Context(r)
+	if !s.isAdmin(ctx) {
+		http.Error(w, "you're not an admin", http.StatusUnauthorized)
+		return
+	}
+	if s.LinkKey == nil {
+		http.Error(w, "share links are not enabled", http.StatusNotFound)
+		return
+	}
+	c := token.Claim{
+		FileSystem: r.PostFormValue("fs"),
+		Path:       r.PostFormValue("file"),
+		Prefix:     r.PostFormValue("prefix") != "",
+	}
+	d := defaultLinkTTL
+	if ttl := r.PostFormValue("ttl"); ttl != "" {
+		var err error
+		d, err = time.ParseDuration(ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d <= 0 {
+			http.Error(w, "ttl must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+	c.Expires = time.Now().Add(d)
+	if uses := r.PostFormValue("uses"); uses != "" {
+		n, err := strconv.Atoi(uses)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n < 0 {
+			http.Error(w, "uses must not be negative", http.StatusBadRequest)
+			return
+		}
+		c.MaxUses = n
+	}
+	t, err := token.Sign(s.LinkKey, c)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	v := url.Values{}
+	v.Set("fs", c.FileSystem)
+	v.Set("file", c.Path)
+	v.Set("t", t)
+	u := url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     s.url("/get"),
+		RawQuery: v.Encode(),
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, u.String())
+}
+
+func (s *Server) removeFS(w http.ResponseWriter, r *http.Request) {
+	ctx := s.Context(r)
+	if !s.isAdmin(ctx) {
+		http.Error(w, "you're not an admin", http.StatusUnauthorized)
+		return
+	}
+	fs := r.PostFormValue("fs")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Visage.RemoveFileSystem(fs); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	for i, sh := range s.State.Shares {
+		if sh.FileSystem != fs {
+			continue
+		}
+		for _, g := range sh.Grants {
+			if cancel, ok := s.cancels[g.ID]; ok {
+				cancel()
+				delete(s.cancels, g.ID)
+			}
+		}
+		s.State.Shares = append(s.State.Shares[:i], s.State.Shares[i+1:]...)
+		break
+	}
+	if err := s.save(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, s.url("/"), http.StatusSeeOther)
 }
 
 func internalError(w http.ResponseWriter, r *http.Request, err error) {
@@ -263,33 +561,114 @@ type Share struct {
 	Root       string  `json:"root"`
 	Name       string  `json:"name"`
 	Grants     []Grant `json:"grants"`
+
+	// Kind is the kind of file system shared, such as KindDirectory.
+	// Shares of other kinds cannot be rebuilt from saved State, and must be
+	// registered with the server's visage.Share before it starts.
+	Kind string `json:"kind,omitempty"`
 }
 
+// KindDirectory is the Kind of a share of a local directory.
+const KindDirectory = "directory"
+
 // ParseGrant parses the given string into a Grant.  s must be of the form
-//     provider:principal[?key=val[&key2=val2]]
-// where the principal is in the grant's Values, and various arguments
-// can be passed via keys.
 //
-// The only key currently supported is ttl, which sets an expiration time.
-func ParseGrant(s string) (Grant, error) {
+//	provider:principal[,principal...][?key=val[&key2=val2]]
+//
+// where the principals are in the grant's Values, and various arguments
+// can be passed via keys.  The provider is the name of a provider in reg.
+//
+// The supported keys are
+//
+//	title    a description of the grant
+//	prefix   a directory the grant is limited to; may be repeated
+//	files    a file the grant is limited to; may be repeated
+//	expires  an RFC 3339 time after which the grant lapses
+//	ttl      a duration after which the grant lapses, converted to expires
+//	maxuses  the number of times the grant may be used
+//	mode     "read" (the default) or "write"
+//
+// Principals and values are URL escaped.
+func ParseGrant(reg *provider.Registry, s string) (Grant, error) {
 	u, err := url.Parse(s)
 	if err != nil {
 		return Grant{}, err
 	}
+	if u.Scheme == "" || u.Opaque == "" {
+		return Grant{}, fmt.Errorf("web: %q: grant must be of the form provider:principal", s)
+	}
 
+	prov, ok := reg.Lookup(u.Scheme)
+	if !ok {
+		return Grant{}, fmt.Errorf("web: %q: no provider %q", s, u.Scheme)
+	}
+	pc, _ := prov.(provider.PrincipalChecker)
 	g := Grant{}
 	g.Provider = u.Scheme
-	g.Values = []string{u.Opaque}
+	for _, p := range strings.Split(u.Opaque, ",") {
+		v, err := url.PathUnescape(p)
+		if err != nil {
+			return Grant{}, fmt.Errorf("web: %q: %v", s, err)
+		}
+		if v == "" {
+			return Grant{}, fmt.Errorf("web: %q: empty principal", s)
+		}
+		if pc != nil {
+			if err := pc.CheckPrincipal(v); err != nil {
+				return Grant{}, fmt.Errorf("web: %q: %v", s, err)
+			}
+		}
+		g.Values = append(g.Values, v)
+	}
 
-	for key := range u.Query() {
-		val := u.Query().Get(key)
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Grant{}, fmt.Errorf("web: %q: %v", s, err)
+	}
+	for key, vals := range q {
+		val := vals[len(vals)-1]
 		switch key {
+		case "title":
+			g.Title = val
+		case "prefix":
+			g.AllowPfx = append(g.AllowPfx, vals...)
+		case "files":
+			g.AllowFiles = append(g.AllowFiles, vals...)
 		case "ttl":
 			d, err := time.ParseDuration(val)
 			if err != nil {
-				return Grant{}, err
+				return Grant{}, fmt.Errorf("web: %q: ttl: %v", s, err)
 			}
+			g.TTL = d
 			g.Expires = time.Now().Add(d)
+		case "expires":
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return Grant{}, fmt.Errorf("web: %q: %v", s, err)
+			}
+			g.Expires = t
+		case "maxuses":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return Grant{}, fmt.Errorf("web: %q: maxuses must be a positive integer", s)
+			}
+			g.MaxUses = n
+		case "mode":
+			switch val {
+			case "read":
+				g.Write = false
+			case "write":
+				g.Write = true
+			default:
+				return Grant{}, fmt.Errorf("web: %q: mode must be read or write", s)
+			}
+		default:
+			return Grant{}, fmt.Errorf("web: %q: unknown key %q", s, key)
+		}
+	}
+	if _, ok := q["ttl"]; ok {
+		if _, ok := q["expires"]; ok {
+			return Grant{}, fmt.Errorf("web: %q: ttl and expires are exclusive", s)
 		}
 	}
 	return g, nil
@@ -302,18 +681,124 @@ type Grant struct {
 	AllowPfx   []string  `json:"allow_prefix"`
 	AllowFiles []string  `json:"allow_files"`
 	Values     []string  `json:"values"`
+	Write      bool      `json:"write"`
+
+	// TTL is the ttl the grant was parsed with, if any.  Expires holds the
+	// deadline it set.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// MaxUses, if positive, limits the number of accesses the grant allows.
+	// Uses are counted in memory, and start over when the server restarts.
+	MaxUses int `json:"max_uses,omitempty"`
+
+	// ID is assigned when the grant is registered with the server's
+	// visage.Share.  It is not persisted.
+	ID visage.OKID `json:"-"`
+}
+
+// String returns the grant in the form accepted by ParseGrant.
+func (g Grant) String() string {
+	var vals []string
+	for _, v := range g.Values {
+		vals = append(vals, escape(v))
+	}
+	var q []string
+	add := func(key, val string) {
+		q = append(q, key+"="+escape(val))
+	}
+	if g.Title != "" {
+		add("title", g.Title)
+	}
+	for _, p := range g.AllowPfx {
+		add("prefix", p)
+	}
+	for _, f := range g.AllowFiles {
+		add("files", f)
+	}
+	switch {
+	case g.TTL != 0:
+		add("ttl", shortDuration(g.TTL))
+	case !g.Expires.IsZero():
+		add("expires", g.Expires.UTC().Format(time.RFC3339))
+	}
+	if g.MaxUses > 0 {
+		add("maxuses", strconv.Itoa(g.MaxUses))
+	}
+	if g.Write {
+		add("mode", "write")
+	}
+	s := g.Provider + ":" + strings.Join(vals, ",")
+	if len(q) > 0 {
+		s += "?" + strings.Join(q, "&")
+	}
+	return s
+}
+
+// shortDuration formats d without the zero units time.Duration.String
+// leaves on, such as "1h" rather than "1h0m0s".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// escape escapes everything in s but the characters that commonly appear in
+// principals and paths, so that grants stay readable.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case strings.IndexByte("-._~/@:", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
 }
 
-func (g Grant) Make() (okay.OK, okay.CancelFunc) {
-	ok := okay.New()
-	switch g.Provider {
-	case "google":
-		ok = google.VerifyEmail(ok, g.Values...)
-	case "github":
-		ok = github.VerifyLogin(ok, g.Values...)
+// Make returns an OK that verifies the grant's principals with the provider
+// in reg, limited to its files and prefixes and bounded by its expiry and
+// uses.
+func (g Grant) Make(reg *provider.Registry) (okay.OK, okay.CancelFunc) {
+	ok := reg.Verify(okay.New(), g.Provider, g.Values...)
+	if g.MaxUses > 0 {
+		ok = okay.Allow(ok, g.counter())
+	}
+	// One call, so that a path may match either a file or a prefix.
+	if len(g.AllowFiles) > 0 || len(g.AllowPfx) > 0 {
+		ok = visage.AllowPaths(ok, g.AllowFiles, g.AllowPfx)
 	}
 	if !g.Expires.IsZero() {
 		ok = okay.WithDeadline(ok, g.Expires)
 	}
 	return okay.WithCancel(ok)
 }
+
+// counter returns a function that allows MaxUses accesses.  Probes and
+// traversals are allowed while uses remain, but are not counted.
+func (g Grant) counter() func(interface{}) (bool, error) {
+	var (
+		mu   sync.Mutex
+		uses int
+	)
+	return func(p interface{}) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if uses >= g.MaxUses {
+			return false, nil
+		}
+		if _, ok := p.(string); ok {
+			uses++
+		}
+		return true, nil
+	}
+}
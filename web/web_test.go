@@ -0,0 +1,577 @@
+//   Copyright 2017 Google
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/okay"
+	"github.com/kurin/visage"
+	"github.com/kurin/visage/provider"
+)
+
+func TestRegisterHandlers(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := os.Mkdir(filepath.Join(d, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "sub", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Visage: visage.New()}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "visage"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+	ok := okay.Verify(okay.New(), func(context.Context) (bool, error) { return true, nil })
+	if _, err := s.Visage.AddOK(d, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		url      string
+		code     int
+		contains string
+	}{
+		{
+			url:      "/visage/",
+			code:     http.StatusOK,
+			contains: "Shares",
+		},
+		{
+			url:  "/visage/missing",
+			code: http.StatusNotFound,
+		},
+		{
+			url:      "/visage/list?" + url.Values{"fs": {d}, "dir": {"sub"}}.Encode(),
+			code:     http.StatusOK,
+			contains: `href="/visage/get?fs=`,
+		},
+		{
+			url:      "/visage/get?" + url.Values{"fs": {d}, "file": {"sub/file"}}.Encode(),
+			code:     http.StatusOK,
+			contains: "data",
+		},
+		{
+			url:  "/get?" + url.Values{"fs": {d}, "file": {"sub/file"}}.Encode(),
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, ent := range table {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", ent.url, nil))
+		if w.Code != ent.code {
+			t.Errorf("GET %s: got %d, want %d", ent.url, w.Code, ent.code)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), ent.contains) {
+			t.Errorf("GET %s: body does not contain %q:\n%s", ent.url, ent.contains, w.Body.String())
+		}
+	}
+
+	// The root without its slash is redirected to the index.
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/visage", nil))
+	if loc := w.Header().Get("Location"); loc != "/visage/" {
+		t.Errorf("GET /visage: got %d to %q, want a redirect to /visage/", w.Code, loc)
+	}
+}
+
+func TestTemplateDir(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "header.html"), []byte("<html><body>themed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Visage:      visage.New(),
+		TemplateDir: d,
+	}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "themed") {
+		t.Errorf("overridden header not used:\n%s", w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "Shares") {
+		t.Errorf("built-in template not used:\n%s", w.Body.String())
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(d, "visage.html"), []byte("{{ .Missing.Field }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = &Server{
+		Visage:      visage.New(),
+		TemplateDir: d,
+	}
+	mux = http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("broken template: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+type userKey struct{}
+
+// testProvider verifies users whose name is stored in the context.
+type testProvider string
+
+func (p testProvider) Name() string                                               { return string(p) }
+func (testProvider) Title() string                                                { return "Web Test" }
+func (testProvider) RegisterHandlers(*http.ServeMux, string, string) error        { return nil }
+func (testProvider) LogoutURL() string                                            { return "" }
+func (testProvider) Context(ctx context.Context, _ *http.Request) context.Context { return ctx }
+
+func (testProvider) Show(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok
+}
+
+func (p testProvider) Verify(ok okay.OK, principals ...string) okay.OK {
+	return okay.Verify(ok, func(ctx context.Context) (bool, error) {
+		user, _ := p.Show(ctx)
+		for _, pr := range principals {
+			if pr == user {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// strictProvider accepts only principals beginning with "ok".
+type strictProvider struct {
+	testProvider
+}
+
+func (strictProvider) CheckPrincipal(p string) error {
+	if !strings.HasPrefix(p, "ok") {
+		return fmt.Errorf("%q is not ok", p)
+	}
+	return nil
+}
+
+func TestParseGrant(t *testing.T) {
+	reg := provider.NewRegistry(testProvider("google"), testProvider("github"), testProvider("oidc"), strictProvider{"strict"})
+	exp := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	table := []struct {
+		s    string
+		want Grant // zero if s is invalid
+	}{
+		{
+			s:    "google:a@example.com",
+			want: Grant{Provider: "google", Values: []string{"a@example.com"}},
+		},
+		{
+			s:    "github:alice,team/myorg/infra",
+			want: Grant{Provider: "github", Values: []string{"alice", "team/myorg/infra"}},
+		},
+		{
+			s: "google:a@example.com,@example.org?title=Quarterly%20reports&prefix=/reports&prefix=/shared&files=/readme.txt&expires=2030-01-02T03:04:05Z&maxuses=3&mode=write",
+			want: Grant{
+				Provider:   "google",
+				Values:     []string{"a@example.com", "@example.org"},
+				Title:      "Quarterly reports",
+				AllowPfx:   []string{"/reports", "/shared"},
+				AllowFiles: []string{"/readme.txt"},
+				Expires:    exp,
+				MaxUses:    3,
+				Write:      true,
+			},
+		},
+		{
+			s:    "oidc:claim/dept%3Dops",
+			want: Grant{Provider: "oidc", Values: []string{"claim/dept=ops"}},
+		},
+		{s: "google"},
+		{s: "google:"},
+		{s: "google:a,,b"},
+		{s: "google:a?mode=admin"},
+		{s: "google:a?maxuses=0"},
+		{s: "google:a?expires=tomorrow"},
+		{s: "google:a?ttl=soon"},
+		{s: "google:a?ttl=1h&expires=2030-01-02T03:04:05Z"},
+		{s: "google:a?colour=blue"},
+		{
+			s:    "strict:ok1,ok2",
+			want: Grant{Provider: "strict", Values: []string{"ok1", "ok2"}},
+		},
+		{s: "strict:ok1,bad"},
+		{s: "webtest:a"},
+	}
+	for _, ent := range table {
+		got, err := ParseGrant(reg, ent.s)
+		if ent.want.Provider == "" {
+			if err == nil {
+				t.Errorf("ParseGrant(%q): got %v, want error", ent.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseGrant(%q): %v", ent.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, ent.want) {
+			t.Errorf("ParseGrant(%q): got %#v, want %#v", ent.s, got, ent.want)
+		}
+		if got.String() != ent.s {
+			t.Errorf("ParseGrant(%q).String(): got %q", ent.s, got.String())
+		}
+	}
+
+	for _, ttl := range []string{"1h", "1h30m", "1m30s", "2h0m5s"} {
+		s := "google:a?ttl=" + ttl
+		g, err := ParseGrant(reg, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := time.ParseDuration(ttl)
+		if left := time.Until(g.Expires); left < d-time.Minute || left > d {
+			t.Errorf("ttl=%s: expires in %v", ttl, left)
+		}
+		if g.String() != s {
+			t.Errorf("ParseGrant(%q).String(): got %q", s, g.String())
+		}
+		again, err := ParseGrant(reg, g.String())
+		if err != nil {
+			t.Errorf("ParseGrant(%q): %v", g.String(), err)
+			continue
+		}
+		if again.TTL != g.TTL {
+			t.Errorf("ParseGrant(%q).String(): got %q, which has ttl %v", s, g.String(), again.TTL)
+		}
+	}
+}
+
+func TestGrantMake(t *testing.T) {
+	reg := provider.NewRegistry(testProvider("webtest"))
+	alice := context.WithValue(context.Background(), userKey{}, "alice")
+	bob := context.WithValue(context.Background(), userKey{}, "bob")
+
+	type access struct {
+		ctx  context.Context
+		path string
+		want bool
+	}
+	table := []struct {
+		grant    string
+		accesses []access
+	}{
+		{
+			grant: "webtest:alice",
+			accesses: []access{
+				{alice, "/any/file", true},
+				{bob, "/any/file", false},
+			},
+		},
+		{
+			grant: "webtest:alice,bob?prefix=/reports&files=/readme.txt",
+			accesses: []access{
+				{alice, "/reports", true},
+				{bob, "reports/q1.txt", true},
+				{alice, "/reports-old/q1.txt", false},
+				{alice, "/readme.txt", true},
+				{alice, "/readme.txt/x", false},
+				{alice, "/other.txt", false},
+			},
+		},
+		{
+			grant: "webtest:alice?maxuses=2",
+			accesses: []access{
+				{bob, "/a", false},
+				{alice, "/a", true},
+				{alice, "/b", true},
+				{alice, "/a", false},
+			},
+		},
+		{
+			grant: "webtest:alice?expires=2001-01-01T00:00:00Z",
+			accesses: []access{
+				{alice, "/a", false},
+			},
+		},
+	}
+	for _, ent := range table {
+		g, err := ParseGrant(reg, ent.grant)
+		if err != nil {
+			t.Errorf("ParseGrant(%q): %v", ent.grant, err)
+			continue
+		}
+		ok, cancel := g.Make(reg)
+		for i, a := range ent.accesses {
+			got, err := okay.Check(a.ctx, a.path, ok)
+			if err != nil {
+				t.Errorf("%s: access %d: %v", ent.grant, i, err)
+				continue
+			}
+			if got != a.want {
+				t.Errorf("%s: access %d (%s): got %v, want %v", ent.grant, i, a.path, got, a.want)
+			}
+		}
+		cancel()
+		if got, _ := okay.Check(alice, "/reports", ok); got {
+			t.Errorf("%s: canceled grant still allows access", ent.grant)
+		}
+	}
+}
+
+func TestUpload(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := &Server{
+		Visage:    visage.New(),
+		Providers: []provider.Provider{testProvider("webtest")},
+		Admin:     okay.Verify(okay.New(), func(context.Context) (bool, error) { return true, nil }),
+	}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	do := func(user, method, route string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, route, body)
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	form := func(user, route string, v url.Values) *httptest.ResponseRecorder {
+		return do(user, "POST", route, strings.NewReader(v.Encode()), "application/x-www-form-urlencoded")
+	}
+	if w := form("admin", "/setfs", url.Values{"fs": {d}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("setfs: got %d: %s", w.Code, w.Body.String())
+	}
+	if w := form("admin", "/setshare", url.Values{"fs": {d}, "grant": {"webtest:alice"}, "mode": {"write"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("setshare: got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The admin grants write access, and finds the page to hand out.
+	w := do("admin", "GET", "/", nil, "")
+	if !strings.Contains(w.Body.String(), `<option value="write">`) {
+		t.Errorf("index: no way to grant write access:\n%s", w.Body.String())
+	}
+	page := "/upload?" + url.Values{"fs": {d}}.Encode()
+	// html/template writes its escapes in lower case.
+	if !strings.Contains(strings.ToLower(w.Body.String()), strings.ToLower(`href="`+page+`"`)) {
+		t.Errorf("index: no link to %s:\n%s", page, w.Body.String())
+	}
+
+	// Alice can write but not read, so she cannot list the directory, but
+	// can still upload from the page.
+	if w := do("alice", "GET", "/list?"+url.Values{"fs": {d}}.Encode(), nil, ""); w.Code != http.StatusForbidden {
+		t.Errorf("list as alice: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w = do("alice", "GET", page, nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `enctype="multipart/form-data"`) {
+		t.Fatalf("upload page: got %d:\n%s", w.Code, w.Body.String())
+	}
+
+	upload := func(user, fs, name string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		mw.WriteField("fs", fs)
+		mw.WriteField("dir", "/")
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, "from "+user)
+		mw.Close()
+		return do(user, "POST", "/upload", &b, mw.FormDataContentType())
+	}
+	table := []struct {
+		user, fs, name string
+		code           int
+	}{
+		{user: "alice", fs: d, name: "alice.txt", code: http.StatusSeeOther},
+		{user: "bob", fs: d, name: "bob.txt", code: http.StatusForbidden},
+		{user: "alice", fs: "missing", name: "alice.txt", code: http.StatusNotFound},
+		{user: "alice", fs: d, name: "", code: http.StatusBadRequest},
+		{user: "alice", fs: d, name: "..", code: http.StatusBadRequest},
+	}
+	for _, ent := range table {
+		w := upload(ent.user, ent.fs, ent.name)
+		if w.Code != ent.code {
+			t.Errorf("upload %q to %s as %s: got %d, want %d: %s", ent.name, ent.fs, ent.user, w.Code, ent.code, w.Body.String())
+			continue
+		}
+		if w.Code != http.StatusSeeOther {
+			continue
+		}
+		loc := w.Header().Get("Location")
+		w = do(ent.user, "GET", loc, nil, "")
+		if want := "Uploaded " + ent.name; w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("following %s: got %d, want a page saying %q:\n%s", loc, w.Code, want, w.Body.String())
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(d, "alice.txt")); err != nil || string(b) != "from alice" {
+		t.Errorf("uploaded file: got %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "bob.txt")); !os.IsNotExist(err) {
+		t.Errorf("bob's upload: got %v, want not found", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := &Server{
+		Visage:  visage.New(),
+		LinkKey: []byte("secret"),
+		Admin:   okay.Verify(okay.New(), func(context.Context) (bool, error) { return true, nil }),
+	}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addFileSystem(visage.NewDirectory(d)); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		ttl, uses string
+		code      int
+	}{
+		{code: http.StatusOK},
+		{ttl: "1h", uses: "2", code: http.StatusOK},
+		{uses: "0", code: http.StatusOK},
+		{uses: "-1", code: http.StatusBadRequest},
+		{uses: "many", code: http.StatusBadRequest},
+		{ttl: "-1h", code: http.StatusBadRequest},
+	}
+	for _, ent := range table {
+		v := url.Values{"fs": {d}, "file": {"f"}, "ttl": {ent.ttl}, "uses": {ent.uses}}
+		r := httptest.NewRequest("POST", "/link", strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != ent.code {
+			t.Errorf("link with ttl %q, uses %q: got %d, want %d: %s", ent.ttl, ent.uses, w.Code, ent.code, w.Body.String())
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		d, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(d)
+		dirs = append(dirs, d)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirs[0], "f"), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Visage:    visage.New(),
+		Providers: []provider.Provider{testProvider("webtest")},
+		Admin:     okay.Verify(okay.New(), func(context.Context) (bool, error) { return true, nil }),
+	}
+	mux := http.NewServeMux()
+	if err := s.RegisterHandlers(mux, "/"); err != nil {
+		t.Fatal(err)
+	}
+	do := func(user, method, route string, v url.Values) int {
+		r := httptest.NewRequest(method, route, strings.NewReader(v.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, d := range dirs {
+		if code := do("admin", "POST", "/setfs", url.Values{"fs": {d}}); code != http.StatusSeeOther {
+			t.Fatalf("setfs %s: got %d", d, code)
+		}
+	}
+	if code := do("admin", "POST", "/setshare", url.Values{"fs": {dirs[0]}, "grant": {"webtest:alice"}}); code != http.StatusSeeOther {
+		t.Fatalf("setshare: got %d", code)
+	}
+	id := s.share(dirs[0]).Grants[0].ID
+	get := "/get?" + url.Values{"fs": {dirs[0]}, "file": {"f"}}.Encode()
+	if code := do("alice", "GET", get, nil); code != http.StatusOK {
+		t.Fatalf("get before revoking: got %d, want %d", code, http.StatusOK)
+	}
+
+	table := []struct {
+		fs   string
+		id   visage.OKID
+		code int
+	}{
+		// The grant is found by its ID, whichever share the form names.
+		{fs: dirs[1], id: id, code: http.StatusSeeOther},
+		{fs: dirs[0], id: id, code: http.StatusNotFound},
+		{fs: dirs[0], id: id + 100, code: http.StatusNotFound},
+	}
+	for _, ent := range table {
+		v := url.Values{"fs": {ent.fs}, "id": {fmt.Sprint(ent.id)}}
+		if code := do("admin", "POST", "/revoke", v); code != ent.code {
+			t.Errorf("revoke %d from %s: got %d, want %d", ent.id, ent.fs, code, ent.code)
+		}
+	}
+	if n := len(s.share(dirs[0]).Grants); n != 0 {
+		t.Errorf("after revoking: %d grants left, want 0", n)
+	}
+	if code := do("alice", "GET", get, nil); code != http.StatusForbidden {
+		t.Errorf("get after revoking: got %d, want %d", code, http.StatusForbidden)
+	}
+}